@@ -0,0 +1,167 @@
+package main
+
+import "fmt"
+
+// BuildTree creates a database in filename holding the pairs keys[i],
+// vals[i], whose keys must be sorted and unique. Instead of inserting them
+// one by one it lays the nodes out level by level from the leaves up, so
+// every block is written once. filename must not hold any key yet.
+func BuildTree(filename string, keys []int64, vals []string, opts ...Option) (*Tree, error) {
+	if len(keys) != len(vals) {
+		return nil, fmt.Errorf("build tree: %d keys but %d values", len(keys), len(vals))
+	}
+	cfg := &Tree{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	for i := 1; i < len(keys); i++ {
+		if !cfg.lessKey(keys[i-1], keys[i]) {
+			return nil, fmt.Errorf("build tree: key %d at %d does not follow %d", keys[i], i, keys[i-1])
+		}
+	}
+
+	t, err := NewTree(filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.build(keys, vals); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Tree) build(keys []int64, vals []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rootOff != INVALID_OFFSET {
+		return fmt.Errorf("build %s: database is not empty", t.file.Name())
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for i, key := range keys {
+		if err := t.checkKey(key); err != nil {
+			return err
+		}
+		if err := t.checkValue(vals[i]); err != nil {
+			return err
+		}
+		if err := t.checkUnique(key, vals[i]); err != nil {
+			return err
+		}
+		t.addValueKey(key, vals[i])
+	}
+
+	// reserve every block up front, growing the file once
+	if err := t.reserveBlocks(t.buildBlocks(vals)); err != nil {
+		return err
+	}
+
+	level := make([]*Node, 0, (len(keys)+t.order-1)/t.order)
+	for i := 0; i < len(keys); i += t.order {
+		j := i + t.order
+		if j > len(keys) {
+			j = len(keys)
+		}
+
+		leaf, err := t.newNodeFromDisk()
+		if err != nil {
+			return err
+		}
+		leaf.IsLeaf = true
+		leaf.Keys = append([]int64(nil), keys[i:j]...)
+		leaf.Values = append([]string(nil), vals[i:j]...)
+		level = append(level, leaf)
+	}
+	linkLevel(level)
+
+	// a level is written once the level above gave it its parents
+	for len(level) > 1 {
+		parents := make([]*Node, 0, (len(level)+t.order-1)/t.order)
+		for i, child := range level {
+			if i%t.order == 0 {
+				parent, err := t.newNodeFromDisk()
+				if err != nil {
+					return err
+				}
+				parents = append(parents, parent)
+			}
+
+			parent := parents[len(parents)-1]
+			parent.Keys = append(parent.Keys, child.Keys[len(child.Keys)-1])
+			parent.Children = append(parent.Children, child.Self)
+			if t.hasCounts() {
+				parent.Counts = append(parent.Counts, child.keyCount())
+			}
+			child.Parent = parent.Self
+		}
+		linkLevel(parents)
+
+		for _, node := range level {
+			if err := t.flushNodeToDisk(node); err != nil {
+				return err
+			}
+		}
+		level = parents
+	}
+
+	if err := t.flushNodeToDisk(level[0]); err != nil {
+		return err
+	}
+	t.rootOff = level[0].Self
+
+	return nil
+}
+
+// buildBlocks tells how many blocks build needs at most for vals: the
+// nodes of every level and the overflow pages of large values
+func (t *Tree) buildBlocks(vals []string) int {
+	blocks := 0
+	for n := len(vals); ; {
+		n = (n + t.order - 1) / t.order
+		blocks += n
+		if n == 1 {
+			break
+		}
+	}
+
+	if !t.separateValues {
+		// compression adds one tag byte at worst
+		size := int(t.blockSize) - 17
+		for _, val := range vals {
+			if n := len(val) + 1; n > t.overflowThreshold() {
+				blocks += (n + size - 1) / size
+			}
+		}
+	}
+
+	return blocks
+}
+
+// reserveBlocks makes sure the free list holds at least n blocks
+func (t *Tree) reserveBlocks(n int) error {
+	if len(t.freeBlocks) >= n {
+		return nil
+	}
+
+	prealloc := t.prealloc
+	t.prealloc = n
+	err := t.allocNewFreeNodeInDisk()
+	t.prealloc = prealloc
+
+	return err
+}
+
+// linkLevel chains the nodes of one level through Next and Prev
+func linkLevel(level []*Node) {
+	for i := 1; i < len(level); i++ {
+		level[i-1].Next = level[i].Self
+		level[i].Prev = level[i-1].Self
+	}
+}
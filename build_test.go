@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildTree(t *testing.T) {
+	dir := t.TempDir()
+
+	keys := make([]int64, 0, 1000)
+	vals := make([]string, 0, 1000)
+	for i := int64(1); i <= 1000; i++ {
+		keys = append(keys, i*3)
+		if i%100 == 0 {
+			vals = append(vals, string(bytes.Repeat([]byte{'v'}, 5000)))
+		} else {
+			vals = append(vals, fmt.Sprintf("test%d", i))
+		}
+	}
+
+	if _, err := BuildTree(filepath.Join(dir, "unsorted.db"), []int64{2, 1}, []string{"b", "a"}); err == nil {
+		t.Fatal("expected unsorted keys to be rejected")
+	}
+
+	filename := filepath.Join(dir, "build.db")
+	tree, err := BuildTree(filename, keys, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every block in use was written exactly once, after the header
+	active, _, _, err := tree.SpaceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(tree.writes) != active+1 {
+		t.Fatalf("%d writes for %d blocks", tree.writes, active)
+	}
+
+	for i, key := range keys {
+		if val, err := tree.Find(key); err != nil || val != vals[i] {
+			t.Fatalf("key %d: got %d bytes, %v", key, len(val), err)
+		}
+	}
+
+	if err := tree.Insert(3001, "test3001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := BuildTree(filename, keys, vals); err == nil {
+		t.Fatal("expected a non empty database to be rejected")
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(keys)+1 {
+		t.Fatalf("got %d keys, expected %d", len(got), len(keys)+1)
+	}
+}
+
+// BENCHMARK_KEYS is how many pairs the BuildTree benchmarks write, small
+// enough for the one by one Insert baseline to finish in seconds; the ratio
+// between the two is what matters
+const BENCHMARK_KEYS = 10000
+
+func benchmarkKeys() ([]int64, []string) {
+	keys := make([]int64, BENCHMARK_KEYS)
+	vals := make([]string, BENCHMARK_KEYS)
+	for i := range keys {
+		keys[i] = int64(i)
+		vals[i] = "value"
+	}
+	return keys, vals
+}
+
+func BenchmarkBuildTree(b *testing.B) {
+	keys, vals := benchmarkKeys()
+	for n := 0; n < b.N; n++ {
+		tree, err := BuildTree(filepath.Join(b.TempDir(), "bench.db"), keys, vals)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tree.Close()
+	}
+}
+
+func BenchmarkBuildTreeInsert(b *testing.B) {
+	keys, vals := benchmarkKeys()
+	for n := 0; n < b.N; n++ {
+		tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for i, key := range keys {
+			if err := tree.Insert(key, vals[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		tree.Close()
+	}
+}
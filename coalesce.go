@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// Flush writes out the blocks held back by CoalesceWrites
+func (t *Tree) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.flushDirty()
+}
+
+// SetAutoFlush(false) keeps every written node in memory until Flush, Sync
+// or Close, however many there are, which speeds bulk loads up as a node
+// changed by many inserts is written once. Nothing of what was written
+// since the last Flush is on disk: a crash loses all of it, and the memory
+// used grows with the number of nodes touched. SetAutoFlush(true) writes
+// the pending nodes out and goes back to writing them as they change, or
+// as CoalesceWrites allows.
+func (t *Tree) SetAutoFlush(on bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.manualFlush = !on
+	if !on {
+		return nil
+	}
+
+	return t.flushDirty()
+}
+
+// bufferWrite keeps the encoded block in memory, replacing any pending write
+// of the same offset, and writes everything out once the buffer is full
+func (t *Tree) bufferWrite(data []byte, off int64) error {
+	if t.dirty == nil {
+		t.dirty = make(map[int64][]byte)
+	}
+	t.dirty[off] = data
+
+	if !t.manualFlush && len(t.dirty) > t.coalesceLimit {
+		return t.flushDirty()
+	}
+
+	return nil
+}
+
+// flushDirty writes the pending blocks in offset order
+func (t *Tree) flushDirty() error {
+	offs := make([]int64, 0, len(t.dirty))
+	for off := range t.dirty {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+
+	for _, off := range offs {
+		if err := t.writeAt(t.dirty[off], off); err != nil {
+			return err
+		}
+		delete(t.dirty, off)
+	}
+
+	return nil
+}
+
+// writeBlock writes data at off, through the buffer if CoalesceWrites is on
+func (t *Tree) writeBlock(data []byte, off int64) error {
+	if t.coalesceLimit > 0 || t.manualFlush {
+		return t.bufferWrite(data, off)
+	}
+
+	return t.writeAt(data, off)
+}
+
+func (t *Tree) writeAt(data []byte, off int64) error {
+	t.writes++
+	if length, err := t.file.WriteAt(data, off); err != nil {
+		return err
+	} else if len(data) != length {
+		return fmt.Errorf("%w: writeat %d into %s, expected len = %d but get %d", io.ErrShortWrite, off, t.file.Name(), len(data), length)
+	}
+
+	return nil
+}
+
+// readAt reads from the pending block if the range has not been written yet,
+// then from the mapping if it covers the range, then from the file
+func (t *Tree) readAt(buf []byte, off int64) (int, error) {
+	atomic.AddInt64(&t.reads, 1)
+
+	base := off - off%int64(t.blockSize)
+	if data, ok := t.dirty[base]; ok {
+		if off-base >= int64(len(data)) {
+			return 0, io.EOF
+		}
+		return copy(buf, data[off-base:]), nil
+	}
+
+	if end := off + int64(len(buf)); end <= int64(len(t.mapped)) {
+		return copy(buf, t.mapped[off:end]), nil
+	}
+
+	return t.file.ReadAt(buf, off)
+}
+
+// readBlock reads the block at off with a single read. It may come back
+// shorter than a block at the end of a file written before the header
+// existed, but always holds at least the 8 bytes every node starts with.
+// Reading at or past the end of the file fails with ErrorOffsetOutOfRange,
+// a block cut short with ErrorShortRead.
+func (t *Tree) readBlock(off int64) ([]byte, error) {
+	buf := make([]byte, t.blockSize)
+	n, err := t.readAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n == 0 && err == io.EOF {
+		return nil, fmt.Errorf("%w: %v is past the end of %v", ErrorOffsetOutOfRange, off, t.file.Name())
+	}
+
+	if n < 8 {
+		return nil, fmt.Errorf("%w: read at %v from %v, expect len = %v but got %v", ErrorShortRead, off, t.file.Name(), 8, n)
+	}
+
+	return buf[:n], nil
+}
+
+// storedSize is the size of the file once pending blocks are written
+func (t *Tree) storedSize() (int64, error) {
+	size, err := t.file.Size()
+	if err != nil {
+		return 0, err
+	}
+	for off, data := range t.dirty {
+		if end := off + int64(len(data)); end > size {
+			size = end
+		}
+	}
+
+	return size, nil
+}
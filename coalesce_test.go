@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCoalesceWrites(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "coalesce.db")
+	tree, err := NewTree(filename, CoalesceWrites(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 500; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// buffered blocks are visible to reads
+	for i := int64(1); i <= 500; i += 7 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 500; i++ {
+		val, err := tree.Find(i)
+		if i%7 == 1 {
+			if err != ErrorNotFoundKey {
+				t.Fatalf("key %d: expected %v, got %v", i, ErrorNotFoundKey, err)
+			}
+			continue
+		}
+		if err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+}
+
+func TestSetAutoFlush(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "autoflush.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.SetAutoFlush(false); err != nil {
+		t.Fatal(err)
+	}
+	before := tree.writes
+	for i := int64(1); i <= 2000; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tree.writes != before {
+		t.Fatalf("expected nothing written before Flush, got %d writes", tree.writes-before)
+	}
+	if val, err := tree.Find(1000); err != nil || val != "test1000" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.dirty) != 0 {
+		t.Fatalf("%d blocks still pending after Flush", len(tree.dirty))
+	}
+
+	// back on, every write goes straight to the file
+	if err := tree.SetAutoFlush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(2001, "test2001"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.dirty) != 0 {
+		t.Fatalf("%d blocks pending with auto flush on", len(tree.dirty))
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 2001; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+}
+
+func benchmarkAutoFlush(b *testing.B, on bool) {
+	for n := 0; n < b.N; n++ {
+		tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := tree.SetAutoFlush(on); err != nil {
+			b.Fatal(err)
+		}
+
+		for i := int64(1); i <= 50000; i++ {
+			if err := tree.Insert(i, "value"); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if err := tree.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAutoFlushOn(b *testing.B) {
+	benchmarkAutoFlush(b, true)
+}
+
+func BenchmarkAutoFlushOff(b *testing.B) {
+	benchmarkAutoFlush(b, false)
+}
+
+func benchmarkSequentialInsert(b *testing.B, opts ...Option) {
+	var writes int64
+	for n := 0; n < b.N; n++ {
+		tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"), opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for i := int64(1); i <= 10000; i++ {
+			if err := tree.Insert(i, "value"); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if err := tree.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		writes += tree.writes
+		tree.Close()
+	}
+
+	b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSequentialInsert(b *testing.B) {
+	benchmarkSequentialInsert(b)
+}
+
+func BenchmarkSequentialInsertCoalesced(b *testing.B) {
+	benchmarkSequentialInsert(b, CoalesceWrites(64))
+}
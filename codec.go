@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// blockType is the type byte n is written with in a file of the version
+func blockType(n *Node, version uint8) uint8 {
+	switch {
+	case !n.IsActive:
+		return BLOCK_FREE
+	case version < BLOCK_TYPE_VERSION:
+		return BLOCK_NODE
+	case n.IsLeaf:
+		return BLOCK_LEAF
+	case version < SUBTREE_COUNT_VERSION:
+		return BLOCK_INTERNAL
+	}
+	return BLOCK_COUNTED
+}
+
+// encode lays n out as described on Node, datalen included, writing the
+// type byte kind and calling writeVal to encode every value
+func (n *Node) encode(kind uint8, writeVal func(bs *bytes.Buffer, i int) error) ([]byte, error) {
+	bs := bytes.NewBuffer(make([]byte, 4))
+
+	// type
+	if err := binary.Write(bs, binary.LittleEndian, kind); err != nil {
+		return nil, err
+	}
+
+	// isleaf
+	if err := binary.Write(bs, binary.LittleEndian, encodeBool(n.IsLeaf)); err != nil {
+		return nil, err
+	}
+
+	// self, next, prev, parent
+	for _, v := range []int64{n.Self, n.Next, n.Prev, n.Parent} {
+		if err := binary.Write(bs, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	// children
+	if err := binary.Write(bs, binary.LittleEndian, int64(len(n.Children))); err != nil {
+		return nil, err
+	}
+	for _, v := range n.Children {
+		if err := binary.Write(bs, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	// counts
+	if kind == BLOCK_COUNTED {
+		if len(n.Counts) != len(n.Children) {
+			return nil, fmt.Errorf("node at %v has %d children but %d counts", n.Self, len(n.Children), len(n.Counts))
+		}
+		for _, v := range n.Counts {
+			if err := binary.Write(bs, binary.LittleEndian, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// keys
+	if err := binary.Write(bs, binary.LittleEndian, int64(len(n.Keys))); err != nil {
+		return nil, err
+	}
+	for _, v := range n.Keys {
+		if err := binary.Write(bs, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	// values
+	if err := binary.Write(bs, binary.LittleEndian, int64(len(n.Values))); err != nil {
+		return nil, err
+	}
+	for i := range n.Values {
+		if err := writeVal(bs, i); err != nil {
+			return nil, err
+		}
+	}
+
+	data := bs.Bytes()
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-4))
+
+	return data, nil
+}
+
+// decode fills n from data, the bytes after datalen, calling readVal to
+// decode every value into n.Values. Errors name the field that could not
+// be decoded.
+func (n *Node) decode(data []byte, readVal func(bs *bytes.Buffer, i int) error) error {
+	bs := bytes.NewBuffer(data)
+
+	read := func(field string, v interface{}) error {
+		if err := binary.Read(bs, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrorInvalidDBFormat, field, err)
+		}
+		return nil
+	}
+
+	// a count larger than what is left of the block is garbage
+	readCount := func(field string, size int64) (int64, error) {
+		var cnt int64
+		if err := read(field, &cnt); err != nil {
+			return 0, err
+		}
+		if cnt < 0 {
+			return 0, fmt.Errorf("%w: %s %d is negative", ErrorInvalidDBFormat, field, cnt)
+		}
+		if cnt > int64(bs.Len())/size {
+			return 0, fmt.Errorf("%w: %s %d does not fit in the %d bytes left", ErrorInvalidDBFormat, field, cnt, bs.Len())
+		}
+		return cnt, nil
+	}
+
+	// type
+	var kind uint8
+	if err := read("type", &kind); err != nil {
+		return err
+	}
+	switch kind {
+	case BLOCK_LEAF, BLOCK_INTERNAL, BLOCK_COUNTED:
+		n.IsActive = true
+	default:
+		active, err := decodeBool(kind)
+		if err != nil {
+			return fmt.Errorf("type: %w", err)
+		}
+		n.IsActive = active
+	}
+
+	// isleaf
+	var flag uint8
+	if err := read("isleaf", &flag); err != nil {
+		return err
+	}
+	leaf, err := decodeBool(flag)
+	if err != nil {
+		return fmt.Errorf("isleaf: %w", err)
+	}
+	n.IsLeaf = leaf
+
+	// self, next, prev, parent
+	for i, v := range []*int64{&n.Self, &n.Next, &n.Prev, &n.Parent} {
+		if err := read([]string{"self", "next", "prev", "parent"}[i], v); err != nil {
+			return err
+		}
+	}
+
+	if (kind == BLOCK_LEAF && !n.IsLeaf) || ((kind == BLOCK_INTERNAL || kind == BLOCK_COUNTED) && n.IsLeaf) {
+		return fmt.Errorf("%w: node at %v has type %d but isleaf %v", ErrorInvalidDBFormat, n.Self, kind, n.IsLeaf)
+	}
+
+	// children
+	childCnt, err := readCount("childcnt", 8)
+	if err != nil {
+		return err
+	}
+	n.Children = make([]int64, childCnt)
+	for i := range n.Children {
+		if err := read(fmt.Sprintf("child %d", i), &n.Children[i]); err != nil {
+			return err
+		}
+	}
+
+	// counts
+	if kind == BLOCK_COUNTED {
+		n.Counts = make([]int64, childCnt)
+		for i := range n.Counts {
+			if err := read(fmt.Sprintf("count %d", i), &n.Counts[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// keys
+	keysCnt, err := readCount("keyscnt", 8)
+	if err != nil {
+		return err
+	}
+	n.Keys = make([]int64, keysCnt)
+	for i := range n.Keys {
+		if err := read(fmt.Sprintf("key %d", i), &n.Keys[i]); err != nil {
+			return err
+		}
+	}
+
+	// values, each one starts with its 4 byte length
+	valuesCnt, err := readCount("valuescnt", 4)
+	if err != nil {
+		return err
+	}
+	// every lookup pairs a key of a leaf with the value at the same index
+	if n.IsActive && n.IsLeaf && valuesCnt != keysCnt {
+		return fmt.Errorf("%w: leaf at %v has %d keys but %d values", ErrorInvalidDBFormat, n.Self, keysCnt, valuesCnt)
+	}
+	n.Values = make([]string, valuesCnt)
+	for i := range n.Values {
+		if err := readVal(bs, i); err != nil {
+			return fmt.Errorf("value %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes n as a block of the current format, datalen
+// included, with every value inline and uncompressed. Values kept out of
+// line or compressed only exist in the file of a tree. An internal node
+// without Counts is written as BLOCK_INTERNAL.
+func (n *Node) MarshalBinary() ([]byte, error) {
+	kind := blockType(n, DB_VERSION)
+	if kind == BLOCK_COUNTED && n.Counts == nil {
+		kind = BLOCK_INTERNAL
+	}
+
+	return n.encode(kind, func(bs *bytes.Buffer, i int) error {
+		if len(n.Values[i]) >= OVERFLOW_FLAG {
+			return fmt.Errorf("%w: value %d has %d bytes", ErrorValueTooLarge, i, len(n.Values[i]))
+		}
+		if err := binary.Write(bs, binary.LittleEndian, uint32(len(n.Values[i]))); err != nil {
+			return err
+		}
+		_, err := bs.WriteString(n.Values[i])
+		return err
+	})
+}
+
+// UnmarshalBinary decodes a block written by MarshalBinary, or by a tree
+// without compression whose values are all inline
+func (n *Node) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("%w: %d bytes", ErrorShortRead, len(data))
+	}
+
+	dataLen := binary.LittleEndian.Uint32(data)
+	if int(dataLen)+4 > len(data) {
+		return fmt.Errorf("%w: expect len = %v but got %v", ErrorShortRead, dataLen+4, len(data))
+	}
+
+	*n = Node{
+		Self:   INVALID_OFFSET,
+		Next:   INVALID_OFFSET,
+		Prev:   INVALID_OFFSET,
+		Parent: INVALID_OFFSET,
+	}
+
+	// a block never written
+	if dataLen == 0 {
+		return nil
+	}
+
+	if data[4] == OVERFLOW_PAGE {
+		return fmt.Errorf("%w: an overflow page is not a node", ErrorInvalidDBFormat)
+	}
+
+	return n.decode(data[4:4+dataLen], func(bs *bytes.Buffer, i int) error {
+		var strLen uint32
+		if err := binary.Read(bs, binary.LittleEndian, &strLen); err != nil {
+			return err
+		}
+		if strLen&OVERFLOW_FLAG != 0 {
+			return fmt.Errorf("%w: value %d is stored out of line", ErrorInvalidDBFormat, i)
+		}
+
+		val := make([]byte, strLen)
+		if err := binary.Read(bs, binary.LittleEndian, &val); err != nil {
+			return err
+		}
+		n.Values[i] = string(val)
+
+		return nil
+	})
+}
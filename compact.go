@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Compact rewrites all live key/value pairs into a fresh file and swaps it
+// over the original, dropping the inactive blocks left behind.
+// It holds the write lock throughout, so concurrent reads wait for the swap
+// and never see offsets of one file applied to the other.
+func (t *Tree) Compact() error {
+	return t.CompactContext(context.Background(), nil)
+}
+
+// CompactContext is like Compact, but checks ctx between rewritten leaves and
+// reports progress as (leaves rewritten, total leaves) if progress is not nil.
+// The original file is only replaced once the new one is completely written,
+// so a cancelled or failed compaction leaves it untouched.
+func (t *Tree) CompactContext(ctx context.Context, progress func(done, total int)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the new tree is written next to the file and renamed over it
+	f, ok := t.file.(fileStore)
+	if !ok {
+		return fmt.Errorf("compact %s: %w", t.file.Name(), ErrorNotAFile)
+	}
+
+	name := f.Name()
+	tmpName := name + ".compact"
+
+	// the compacted values go to a side file of the next generation, the
+	// current one stays in use until the tree file is swapped
+	gen := t.valuesGen
+	if t.separateValues {
+		gen++
+	}
+
+	total, err := t.countLeaves()
+	if err != nil {
+		return err
+	}
+
+	removeTmp := func() {
+		os.Remove(tmpName)
+		os.Remove(valuesName(tmpName, gen))
+	}
+
+	if err := os.Remove(tmpName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(valuesName(tmpName, gen)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fstat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the new file replaces the old one, so it gets the same permissions
+	dst, err := NewTree(tmpName, append(t.options(), FileMode(fstat.Mode().Perm()), valuesGeneration(gen))...)
+	if err != nil {
+		return err
+	}
+
+	if err := t.copyLeavesInto(ctx, dst, total, progress); err != nil {
+		dst.Close()
+		removeTmp()
+		return err
+	}
+
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		removeTmp()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		removeTmp()
+		return err
+	}
+
+	// Windows cannot rename or remove an open file, so the old tree file
+	// and side file are closed first, the new ones already are, and the
+	// tree is opened again whether the renames worked or not. A crash
+	// before the renames leaves the original as it was, next to a temp
+	// file the next Compact removes.
+	if err := t.flushDirty(); err != nil {
+		removeTmp()
+		return err
+	}
+	if err := t.unmap(); err != nil {
+		removeTmp()
+		return err
+	}
+	if err := t.closeValues(); err != nil {
+		removeTmp()
+		return err
+	}
+	if err := t.file.Close(); err != nil {
+		removeTmp()
+		return err
+	}
+
+	renameErr := t.renameCompacted(tmpName, name, gen)
+	if renameErr != nil {
+		removeTmp()
+	}
+
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	t.file = fileStore{file}
+
+	if err := t.load(); err != nil {
+		return err
+	}
+
+	return renameErr
+}
+
+// renameCompacted moves the files of the compacted tree over the ones of
+// the tree and syncs their directory. The side file of generation gen is
+// new, moving it in changes nothing for the tree file in place; renaming
+// the tree file is the single step switching to the compacted tree, after
+// which the side file of the previous generation is unused and removed. A
+// crash at any point leaves a tree file along with the side file it was
+// written with, and at worst an unused side file.
+func (t *Tree) renameCompacted(tmpName, name string, gen uint32) error {
+	if t.separateValues {
+		// left by a crash during an earlier Compact
+		if err := os.Remove(valuesName(name, gen)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(valuesName(tmpName, gen), valuesName(name, gen)); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(name)); err != nil {
+			return err
+		}
+	}
+
+	if compactBeforeSwap != nil {
+		if err := compactBeforeSwap(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpName, name); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	if t.separateValues && gen != t.valuesGen {
+		os.Remove(valuesName(name, t.valuesGen))
+	}
+
+	return nil
+}
+
+// compactBeforeSwap is called by Compact between moving the new side file
+// in and renaming the tree file, tests use it to stop a compaction there
+var compactBeforeSwap func() error
+
+// Rewrite copies every pair into a new database at dst laid out with blocks
+// of newBlockSize bytes, keeping the other options of t. t itself is left as
+// it is, dst records its block size and opens without BlockSize. It fails
+// if dst exists or if a leaf full of out of line values would not fit in the
+// new block size.
+func (t *Tree) Rewrite(newBlockSize uint32, dst string) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// every value can go to overflow pages, but the leaf still has to hold
+	// a length and an offset for each of its keys
+	if (&Tree{blockSize: newBlockSize, order: t.order}).overflowThreshold() < 12 {
+		return fmt.Errorf("%w: block size %d cannot hold %d keys", ErrorNodeTooLarge, newBlockSize, t.order)
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.PathError{Op: "rewrite", Path: dst, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	removeDst := func() {
+		os.Remove(dst)
+		os.Remove(dst + VALUES_SUFFIX)
+	}
+
+	out, err := NewTree(dst, append(t.options(), BlockSize(newBlockSize))...)
+	if err != nil {
+		removeDst()
+		return err
+	}
+
+	if err := t.copyLeavesInto(context.Background(), out, 0, nil); err != nil {
+		out.Close()
+		removeDst()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		removeDst()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		removeDst()
+		return err
+	}
+
+	return nil
+}
+
+// CloneTo copies the database block for block into a new file at dst,
+// side file included, and opens the copy with the options of t. Writes
+// still buffered by CoalesceWrites are copied too. It holds the read lock
+// during the copy, so the clone is a consistent point in time. It fails if
+// dst exists.
+func (t *Tree) CloneTo(dst string) (*Tree, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if _, err := os.Lstat(dst); err == nil {
+		return nil, &os.PathError{Op: "clone", Path: dst, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// the header copied along keeps the side file generation
+	removeDst := func() {
+		os.Remove(dst)
+		os.Remove(valuesName(dst, t.valuesGen))
+	}
+
+	size, err := t.file.Size()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.copyRegion(t.file.ReadAt, size, t.dirty, dst); err != nil {
+		removeDst()
+		return nil, err
+	}
+
+	if t.separateValues {
+		if err := t.copyRegion(t.vals.ReadAt, t.valsSize, nil, valuesName(dst, t.valuesGen)); err != nil {
+			removeDst()
+			return nil, err
+		}
+	}
+
+	clone, err := NewTree(dst, append(t.options(), FileMode(t.fileMode))...)
+	if err != nil {
+		removeDst()
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+// copyRegion creates dst holding the first size bytes readAt gives, read a
+// block at a time, then writes the pending blocks over them the way
+// flushDirty would
+func (t *Tree) copyRegion(readAt func(buf []byte, off int64) (int, error), size int64, pending map[int64][]byte, dst string) error {
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, t.fileMode)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, t.blockSize)
+	for off := int64(0); off < size; off += int64(len(buf)) {
+		chunk := buf
+		if rest := size - off; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+
+		n, err := readAt(chunk, off)
+		if n < len(chunk) {
+			file.Close()
+			return fmt.Errorf("%w: read at %v, expect len = %v but got %v: %v", ErrorShortRead, off, len(chunk), n, err)
+		}
+
+		if _, err := file.WriteAt(chunk, off); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	for off, data := range pending {
+		if _, err := file.WriteAt(data, off); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (t *Tree) countLeaves() (int, error) {
+	if t.rootOff == INVALID_OFFSET {
+		return 0, nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return 0, err
+	}
+
+	cnt := 1
+	for leaf.Next != INVALID_OFFSET {
+		if leaf, err = t.seekNode(leaf.Next); err != nil {
+			return 0, err
+		}
+		cnt++
+	}
+
+	return cnt, nil
+}
+
+func (t *Tree) copyLeavesInto(ctx context.Context, dst *Tree, total int, progress func(done, total int)) error {
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return err
+	}
+
+	for done := 1; ; done++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for i, key := range leaf.Keys {
+			if err := dst.Insert(key, leaf.Values[i]); err != nil {
+				return err
+			}
+		}
+
+		if progress != nil {
+			progress(done, total)
+		}
+
+		if leaf.Next == INVALID_OFFSET {
+			return nil
+		}
+
+		if leaf, err = t.seekNode(leaf.Next); err != nil {
+			return err
+		}
+	}
+}
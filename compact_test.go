@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCompactContext(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lastDone, lastTotal int
+	err = tree.CompactContext(context.Background(), func(done, total int) {
+		lastDone, lastTotal = done, total
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastTotal == 0 || lastDone != lastTotal {
+		t.Fatalf("progress ended at %d/%d", lastDone, lastTotal)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		val, err := tree.Find(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q", i, val)
+		}
+	}
+}
+
+func TestCompactContextCancel(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = tree.CompactContext(ctx, func(done, total int) {
+		if done == 2 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	after, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("original file changed by a cancelled compaction")
+	}
+
+	if _, err := os.Stat(filename + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+
+	if val, err := tree.Find(50); err != nil || val != "test50" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func TestCompactKeepsFingerprint(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "compact.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	empty, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 100; i += 3 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == empty {
+		t.Fatal("fingerprint does not depend on the content")
+	}
+
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Fatalf("fingerprint changed from %x to %x", before, after)
+	}
+
+	if err := tree.Update(2, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := tree.Fingerprint(); err != nil || changed == after {
+		t.Fatalf("fingerprint %x did not change with a value, %v", changed, err)
+	}
+}
+
+func TestCompactConcurrentReads(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "compact.db"), UseMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 200; i += 2 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key := int64((n*7+r)%100)*2 + 2
+				if val, err := tree.Find(key); err != nil || val != fmt.Sprintf("test%d", key) {
+					errs <- fmt.Errorf("key %d: got %q, %v", key, val, err)
+					return
+				}
+			}
+		}(r)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := tree.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := NewTree(filepath.Join(dir, "small.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// every tenth value is larger than a 4096 block
+	val := func(i int64) string {
+		if i%10 == 0 {
+			return string(bytes.Repeat([]byte{byte('a' + i%26)}, 5000))
+		}
+		return fmt.Sprintf("test%d", i)
+	}
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tree.Rewrite(64, filepath.Join(dir, "tiny.db")); err == nil {
+		t.Fatal("expected a block size of 64 to be rejected")
+	}
+
+	dst := filepath.Join(dir, "large.db")
+	if err := tree.Rewrite(8192, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Rewrite(8192, dst); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected %v, got %v", os.ErrExist, err)
+	}
+
+	// the block size comes from the header, a different one is refused
+	if _, err := NewTree(dst, BlockSize(4096)); !errors.Is(err, ErrorBlockSizeMismatch) {
+		t.Fatalf("expected %v, got %v", ErrorBlockSizeMismatch, err)
+	}
+	large, err := NewTree(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer large.Close()
+	if large.blockSize != 8192 {
+		t.Fatalf("opened with blocks of %d bytes, expected 8192", large.blockSize)
+	}
+
+	if err := large.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 200; i++ {
+		if got, err := large.Find(i); err != nil || got != val(i) {
+			t.Fatalf("key %d: got %d bytes, %v", i, len(got), err)
+		}
+	}
+
+	want, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := large.Fingerprint(); err != nil || got != want {
+		t.Fatalf("fingerprint %x, want %x, %v", got, want, err)
+	}
+}
+
+func TestCloneTo(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"coalesced": {CoalesceWrites(8)},
+		"separate":  {SeparateValues()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			tree, err := NewTree(filepath.Join(dir, "src.db"), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+
+			for i := int64(1); i <= 300; i++ {
+				if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := int64(1); i <= 300; i += 7 {
+				if err := tree.Delete(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := filepath.Join(dir, "clone.db")
+			clone, err := tree.CloneTo(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clone.Close()
+
+			if _, err := tree.CloneTo(dst); !errors.Is(err, os.ErrExist) {
+				t.Fatalf("expected %v, got %v", os.ErrExist, err)
+			}
+
+			if err := clone.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			want, err := tree.Fingerprint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := clone.Fingerprint(); err != nil || got != want {
+				t.Fatalf("fingerprint %x, want %x, %v", got, want, err)
+			}
+
+			// the two databases change independently
+			if err := clone.Insert(1000, "clone"); err != nil {
+				t.Fatal(err)
+			}
+			if err := clone.Delete(2); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tree.Find(1000); err != ErrorNotFoundKey {
+				t.Fatalf("expected %v, got %v", ErrorNotFoundKey, err)
+			}
+			if val, err := tree.Find(2); err != nil || val != "test2" {
+				t.Fatalf("got %q, %v", val, err)
+			}
+			if got, err := tree.Fingerprint(); err != nil || got != want {
+				t.Fatalf("source changed: fingerprint %x, want %x, %v", got, want, err)
+			}
+		})
+	}
+}
+
+func TestCompactCrashBeforeRename(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "crash.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the compacted copy is written and synced, then the process dies
+	if err := tree.Rewrite(tree.blockSize, filename+".compact"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tree.Fingerprint(); err != nil || got != want {
+		t.Fatalf("fingerprint %x, want %x, %v", got, want, err)
+	}
+
+	// the leftover temp file does not get in the way
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("expected the temp file to be gone, got %v", err)
+	}
+	if got, err := tree.Fingerprint(); err != nil || got != want {
+		t.Fatalf("fingerprint %x, want %x, %v", got, want, err)
+	}
+}
+
+func TestCompactCrashBetweenRenames(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "swap.db")
+	tree, err := NewTree(filename, SeparateValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 100; i += 2 {
+		if err := tree.Update(i, fmt.Sprintf("updated%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := tree.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first compaction moves to generation 1 and drops generation 0
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(valuesName(filename, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(valuesName(filename, 0)); !os.IsNotExist(err) {
+		t.Fatalf("expected the old side file to be gone, got %v", err)
+	}
+
+	// the process dies once the new side file is in place
+	crash := errors.New("crash")
+	compactBeforeSwap = func() error { return crash }
+	err = tree.Compact()
+	compactBeforeSwap = nil
+	if err != crash {
+		t.Fatalf("expected %v, got %v", crash, err)
+	}
+	tree.Close()
+	if _, err := os.Stat(valuesName(filename, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree file still goes along with its own side file
+	tree, err = NewTree(filename, SeparateValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if tree.valuesGen != 1 {
+		t.Fatalf("got generation %d, expected 1", tree.valuesGen)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tree.Fingerprint(); err != nil || got != want {
+		t.Fatalf("fingerprint %x, want %x, %v", got, want, err)
+	}
+
+	// the leftover side file does not get in the way
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(valuesName(filename, 1)); !os.IsNotExist(err) {
+		t.Fatalf("expected the old side file to be gone, got %v", err)
+	}
+	if got, err := tree.Fingerprint(); err != nil || got != want {
+		t.Fatalf("fingerprint %x, want %x, %v", got, want, err)
+	}
+}
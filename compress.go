@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Compression selects how leaf values are compressed on disk
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	GzipCompression
+)
+
+// COMPRESS_MIN_SIZE is the value length below which values are stored as is
+const COMPRESS_MIN_SIZE = 64
+
+const (
+	valueRaw = iota
+	valueGzip
+)
+
+// packValue encodes a value for disk. With compression enabled every value
+// is prefixed by a byte telling whether it was compressed.
+func (t *Tree) packValue(v string) ([]byte, error) {
+	if t.compression == NoCompression {
+		return []byte(v), nil
+	}
+
+	raw := append([]byte{valueRaw}, v...)
+	if len(v) < COMPRESS_MIN_SIZE {
+		return raw, nil
+	}
+
+	bs := bytes.NewBuffer([]byte{valueGzip})
+	zw := gzip.NewWriter(bs)
+	if _, err := zw.Write([]byte(v)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// not worth it
+	if bs.Len() >= len(raw) {
+		return raw, nil
+	}
+
+	return bs.Bytes(), nil
+}
+
+func (t *Tree) unpackValue(data []byte) (string, error) {
+	if t.compression == NoCompression {
+		return string(data), nil
+	}
+
+	if len(data) == 0 {
+		return "", ErrorInvalidDBFormat
+	}
+
+	switch data[0] {
+	case valueRaw:
+		return string(data[1:]), nil
+	case valueGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return "", err
+		}
+		v, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return "", err
+		}
+		return string(v), nil
+	}
+
+	return "", ErrorInvalidDBFormat
+}
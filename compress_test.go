@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func leafDataLen(t *testing.T, tree *Tree, key int64) uint32 {
+	t.Helper()
+
+	leaf, err := tree.findLeafNode(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := tree.file.ReadAt(buf, leaf.Self); err != nil {
+		t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint32(buf)
+}
+
+func TestValueCompressor(t *testing.T) {
+	big := strings.Repeat("xiaolongbao", 400)
+
+	plain, err := NewTree(filepath.Join(t.TempDir(), "plain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	if err := plain.Insert(1, big[:900]); err != nil {
+		t.Fatal(err)
+	}
+	plainLen := leafDataLen(t, plain, 1)
+
+	filename := filepath.Join(t.TempDir(), "gzip.db")
+	tree, err := NewTree(filename, ValueCompressor(GzipCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert(1, big[:900]); err != nil {
+		t.Fatal(err)
+	}
+	if gzipLen := leafDataLen(t, tree, 1); gzipLen >= plainLen/4 {
+		t.Fatalf("compressed leaf takes %d bytes, uncompressed %d", gzipLen, plainLen)
+	}
+
+	// larger than a block once uncompressed
+	if err := tree.Insert(2, big); err != nil {
+		t.Fatal(err)
+	}
+
+	// small values are kept as is
+	if err := tree.Insert(3, "small"); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := tree.findLeafNode(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, tree.blockSize)
+	n, err := tree.file.ReadAt(raw, leaf.Self)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw[:n], []byte("small")) {
+		t.Fatal("small value was compressed")
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the compression is picked up from the header
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for key, want := range map[int64]string{1: big[:900], 2: big, 3: "small"} {
+		if val, err := tree.Find(key); err != nil || val != want {
+			t.Fatalf("key %d: got %d bytes, %v", key, len(val), err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// CHECKPOINT_MAGIC starts a checkpoint token, it reads as "XLBC"
+	CHECKPOINT_MAGIC   = 0x43424c58
+	CHECKPOINT_VERSION = 1
+)
+
+var ErrorInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// Cursor walks the keys in the key order of the tree, one pair per Next.
+// It only remembers the last key it returned, so writes between calls are
+// fine: a pair inserted after that key is seen, a deleted one is not.
+type Cursor struct {
+	t       *Tree
+	last    int64
+	started bool
+}
+
+// NewCursor returns a cursor before the first key of the tree
+func (t *Tree) NewCursor() *Cursor {
+	return &Cursor{t: t}
+}
+
+// Next returns the pair following the last one returned, ok is false once
+// there is none left
+func (c *Cursor) Next() (key int64, val string, ok bool, err error) {
+	if !c.started {
+		key, val, ok, err = c.t.Min()
+	} else {
+		var keys []int64
+		var vals []string
+		keys, vals, err = c.t.RangeAfter(c.last, 1)
+		if len(keys) > 0 {
+			key, val, ok = keys[0], vals[0], true
+		}
+	}
+	if err != nil || !ok {
+		return 0, "", false, err
+	}
+
+	c.last = key
+	c.started = true
+
+	return key, val, true, nil
+}
+
+// Checkpoint encodes where c stands so that ResumeFrom can carry on from
+// there later, even in another process. The token is opaque.
+// the token:
+// [magic uint32][version uint8][started uint8][last int64]
+func (t *Tree) Checkpoint(c *Cursor) []byte {
+	token := make([]byte, 14)
+	binary.LittleEndian.PutUint32(token, CHECKPOINT_MAGIC)
+	token[4] = CHECKPOINT_VERSION
+	token[5] = encodeBool(c.started)
+	binary.LittleEndian.PutUint64(token[6:], uint64(c.last))
+
+	return token
+}
+
+// ResumeFrom returns a cursor carrying on after the key a Checkpoint token
+// was taken at. If that key was deleted since, it resumes at the next key.
+func (t *Tree) ResumeFrom(token []byte) (*Cursor, error) {
+	if len(token) != 14 || binary.LittleEndian.Uint32(token) != CHECKPOINT_MAGIC {
+		return nil, ErrorInvalidCheckpoint
+	}
+	if token[4] != CHECKPOINT_VERSION {
+		return nil, fmt.Errorf("%w: version %d is not %d", ErrorInvalidCheckpoint, token[4], CHECKPOINT_VERSION)
+	}
+
+	started, err := decodeBool(token[5])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidCheckpoint, err)
+	}
+
+	return &Cursor{t: t, last: int64(binary.LittleEndian.Uint64(token[6:])), started: started}, nil
+}
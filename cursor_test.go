@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cursor.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []int64
+	c := tree.NewCursor()
+	for len(seen) < 20 {
+		key, val, ok, err := c.Next()
+		if err != nil || !ok {
+			t.Fatalf("got %v, %v", ok, err)
+		}
+		if val != fmt.Sprintf("test%d", key) {
+			t.Fatalf("got %q for key %d", val, key)
+		}
+		seen = append(seen, key)
+	}
+	token := tree.Checkpoint(c)
+
+	// the checkpointed key goes away before resuming
+	if err := tree.Delete(20); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	c, err = tree.ResumeFrom(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		key, _, ok, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		seen = append(seen, key)
+	}
+
+	if len(seen) != 50 {
+		t.Fatalf("got %d keys, expected 50", len(seen))
+	}
+	for i, key := range seen {
+		if key != int64(i+1) {
+			t.Fatalf("got key %d at %d", key, i)
+		}
+	}
+
+	// a checkpoint taken before the first key starts over
+	c, err = tree.ResumeFrom(tree.Checkpoint(tree.NewCursor()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _, ok, err := c.Next(); err != nil || !ok || key != 1 {
+		t.Fatalf("got %d, %v, %v", key, ok, err)
+	}
+
+	if _, err := tree.ResumeFrom([]byte("garbage")); !errors.Is(err, ErrorInvalidCheckpoint) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidCheckpoint, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// DUMP_MAGIC starts a dump stream, it reads as "XLBP" on disk
+	DUMP_MAGIC   = 0x50424c58
+	DUMP_VERSION = 1
+)
+
+var ErrorInvalidDump = errors.New("invalid dump")
+
+// Dump writes every pair to w in ascending key order, independent of the
+// on-disk layout, so that Load can rebuild the data in any format.
+// the stream:
+// [magic uint32][version uint8]
+// ([1 uint8][key int64][vallen uint32][val])...
+// [0 uint8]
+func (t *Tree) Dump(w io.Writer) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	return t.export(w, t.ascendAll)
+}
+
+// ExportRange writes the pairs with lo <= key <= hi to w in the format of
+// Dump, for ImportRange to apply on another tree
+func (t *Tree) ExportRange(w io.Writer, lo, hi int64) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	return t.export(w, func(fn func(key int64, val string) bool) error {
+		if t.lessKey(hi, lo) {
+			return nil
+		}
+		return t.ascend(lo, func(key int64, val string) bool {
+			return !t.lessKey(hi, key) && fn(key, val)
+		})
+	})
+}
+
+// export writes the pairs walk goes through to w in the format of Dump
+func (t *Tree) export(w io.Writer, walk func(fn func(key int64, val string) bool) error) error {
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, uint32(DUMP_MAGIC)); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(DUMP_VERSION); err != nil {
+		return err
+	}
+
+	var werr error
+	err := walk(func(key int64, val string) bool {
+		werr = writeDumpPair(bw, key, val)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+
+	if err := bw.WriteByte(0); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func writeDumpPair(w *bufio.Writer, key int64, val string) error {
+	if err := w.WriteByte(1); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, key); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(val))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(val)
+	return err
+}
+
+// Load creates a database in filename from a stream written by Dump,
+// laid out according to opts. The database must not hold any key yet.
+func Load(filename string, r io.Reader, opts ...Option) (*Tree, error) {
+	t, err := NewTree(filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.loadDump(r); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Tree) loadDump(r io.Reader) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rootOff != INVALID_OFFSET {
+		return fmt.Errorf("load into %s: database is not empty", t.file.Name())
+	}
+
+	// pairs come sorted, so every insert appends to the last leaf
+	return readDump(r, t.insert)
+}
+
+// ImportRange applies a stream written by ExportRange or Dump, inserting
+// the missing keys and overwriting the values of existing ones
+func (t *Tree) ImportRange(r io.Reader) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	return readDump(r, func(key int64, val string) error {
+		err := t.insert(key, val)
+		if err == ErrorHasExistedKey {
+			return t.update(key, val)
+		}
+		return err
+	})
+}
+
+// readDump checks the stream header and calls fn for every pair
+func readDump(r io.Reader, fn func(key int64, val string) error) error {
+	br := bufio.NewReader(r)
+	var magic uint32
+	if err := binary.Read(br, binary.LittleEndian, &magic); err != nil {
+		return fmt.Errorf("%w: %v", ErrorInvalidDump, err)
+	}
+	if magic != DUMP_MAGIC {
+		return fmt.Errorf("%w: bad magic %#x", ErrorInvalidDump, magic)
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorInvalidDump, err)
+	}
+	if version != DUMP_VERSION {
+		return fmt.Errorf("%w: version %d is not %d", ErrorInvalidDump, version, DUMP_VERSION)
+	}
+
+	for {
+		more, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrorInvalidDump, err)
+		}
+		if more == 0 {
+			return nil
+		}
+
+		var key int64
+		var valLen uint32
+		if err := binary.Read(br, binary.LittleEndian, &key); err != nil {
+			return fmt.Errorf("%w: %v", ErrorInvalidDump, err)
+		}
+		if err := binary.Read(br, binary.LittleEndian, &valLen); err != nil {
+			return fmt.Errorf("%w: %v", ErrorInvalidDump, err)
+		}
+
+		val := make([]byte, valLen)
+		if _, err := io.ReadFull(br, val); err != nil {
+			return fmt.Errorf("%w: %v", ErrorInvalidDump, err)
+		}
+
+		if err := fn(key, string(val)); err != nil {
+			return err
+		}
+	}
+}
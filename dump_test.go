@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDumpLoad(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "v0.db")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start from a version 0 file, without a header
+	old := &Tree{file: fileStore{file}, blockSize: BLOCK_SIZE}
+	leaf := &Node{
+		IsActive: true,
+		IsLeaf:   true,
+		Self:     0,
+		Next:     INVALID_OFFSET,
+		Prev:     INVALID_OFFSET,
+		Parent:   INVALID_OFFSET,
+		Keys:     []int64{1, 2},
+		Values:   []string{"test1", "test2"},
+	}
+	if err := old.flushNodeToDisk(leaf); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	src, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	long := strings.Repeat("xiaolongbao", 20)
+	for i := int64(3); i <= 300; i++ {
+		if err := src.Insert(i, fmt.Sprintf("%s%d", long, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := src.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Load(filepath.Join(dir, "v1.db"), &buf, BlockSize(8192), Order(16), ValueCompressor(GzipCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if src.version != 0 || dst.version != DB_VERSION {
+		t.Fatalf("expected versions 0 and %d, got %d and %d", DB_VERSION, src.version, dst.version)
+	}
+	if err := dst.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	srcKeys, err := src.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstKeys, err := dst.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(srcKeys, dstKeys) {
+		t.Fatalf("got keys %v, expected %v", dstKeys, srcKeys)
+	}
+
+	for _, key := range srcKeys {
+		want, err := src.Find(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val, err := dst.Find(key); err != nil || val != want {
+			t.Fatalf("key %d: got %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestLoadInvalidDump(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	src := newRangeTestTree(t, 10)
+	defer src.Close()
+	if err := src.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut before the end marker
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	if _, err := Load(filepath.Join(dir, "truncated.db"), truncated); !errors.Is(err, ErrorInvalidDump) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDump, err)
+	}
+
+	if _, err := Load(filepath.Join(dir, "garbage.db"), strings.NewReader("garbage")); !errors.Is(err, ErrorInvalidDump) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDump, err)
+	}
+}
+
+func TestExportImportRange(t *testing.T) {
+	src := newRangeTestTree(t, 30)
+	defer src.Close()
+
+	var buf bytes.Buffer
+	if err := src.ExportRange(&buf, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newRangeTestTree(t, 9)
+	defer dst.Close()
+
+	// an existing key takes the exported value
+	if err := dst.Insert(10, "stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.ImportRange(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := dst.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 20 || keys[0] != 1 || keys[19] != 20 {
+		t.Fatalf("expected keys 1 to 20, got %v", keys)
+	}
+	for i := int64(1); i <= 20; i++ {
+		if val, err := dst.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+
+	// an empty range still makes a valid stream
+	buf.Reset()
+	if err := src.ExportRange(&buf, 20, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.ImportRange(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmptyTreeReads(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "empty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	expectNone := func(n int, err error) error {
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			return ErrorHasExistedKey
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name string
+		read func() error
+		want error
+	}{
+		{"Find", func() error { _, err := tree.Find(1); return err }, ErrorNotFoundKey},
+		{"RangeAfter", func() error { keys, _, err := tree.RangeAfter(0, 10); return expectNone(len(keys), err) }, nil},
+		{"NextN", func() error { keys, _, err := tree.NextN(0, 10); return expectNone(len(keys), err) }, nil},
+		{"RangeReverse", func() error { keys, _, err := tree.RangeReverse(10, 0); return expectNone(len(keys), err) }, nil},
+		{"Floor", func() error {
+			_, _, ok, err := tree.Floor(1)
+			if ok {
+				return ErrorHasExistedKey
+			}
+			return err
+		}, nil},
+		{"EstimateRange", func() error { return expectNone(tree.EstimateRange(0, 10)) }, nil},
+		{"AllKeys", func() error { keys, err := tree.AllKeys(); return expectNone(len(keys), err) }, nil},
+		{"Height", func() error { return expectNone(tree.Height()) }, nil},
+		{"LeafOffsetFor", func() error { _, err := tree.LeafOffsetFor(1); return err }, ErrorNotFoundKey},
+		{"EachActiveNode", func() error {
+			return tree.EachActiveNode(func(off int64, n *Node) error { return ErrorHasExistedKey })
+		}, nil},
+		{"Fingerprint", func() error { _, err := tree.Fingerprint(); return err }, nil},
+		{"Verify", tree.Verify, nil},
+		{"Dump", func() error { return tree.Dump(&bytes.Buffer{}) }, nil},
+		{"findLeafNode", func() error { _, err := tree.findLeafNode(1); return err }, ErrorNotFoundKey},
+		{"firstLeafNode", func() error { _, err := tree.firstLeafNode(); return err }, ErrorNotFoundKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.read(); err != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, err := tree.LevelKeys(0); err == nil {
+		t.Fatal("LevelKeys: expected an error, the empty tree has no levels")
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "isempty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if !tree.IsEmpty() {
+		t.Fatal("expected a new tree to be empty")
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if tree.IsEmpty() {
+			t.Fatalf("expected a tree with %d keys not to be empty", i)
+		}
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if tree.IsEmpty() {
+			t.Fatalf("expected a tree with %d keys left not to be empty", 51-i)
+		}
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !tree.IsEmpty() {
+		t.Fatal("expected the tree to be empty after deleting every key")
+	}
+}
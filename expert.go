@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrorNotExpertMode = errors.New("not in expert mode")
+
+// ReadNode decodes the block at off, whatever it holds. It needs the
+// ExpertMode option.
+func (t *Tree) ReadNode(off int64) (_ *Node, err error) {
+	if !t.expertMode {
+		return nil, fmt.Errorf("read node at %d: %w", off, ErrorNotExpertMode)
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	return t.seekNode(off)
+}
+
+// WriteNode writes n to the block at n.Self as it is, without checking it
+// against the rest of the tree, so misuse corrupts the tree. It needs the
+// ExpertMode option.
+func (t *Tree) WriteNode(n *Node) error {
+	if !t.expertMode {
+		return fmt.Errorf("write node: %w", ErrorNotExpertMode)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.flushNodeToDisk(n)
+}
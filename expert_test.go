@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpertMode(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "expert.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.ReadNode(tree.rootOff); !errors.Is(err, ErrorNotExpertMode) {
+		t.Fatalf("expected %v, got %v", ErrorNotExpertMode, err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename, ExpertMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(2); i <= 20; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leaf, err := tree.findLeafNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := tree.ReadNode(leaf.Self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsLeaf || n.Keys[0] != 1 || n.Values[0] != "test1" {
+		t.Fatalf("got %+v", n)
+	}
+
+	n.IsLeaf = false
+	if err := tree.WriteNode(n); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err = tree.ReadNode(leaf.Self); err != nil {
+		t.Fatal(err)
+	}
+	if n.IsLeaf {
+		t.Fatal("expected the node to be written back as an internal node")
+	}
+	if err := tree.Verify(); err == nil {
+		t.Fatal("expected Verify to notice the broken leaf")
+	}
+}
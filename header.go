@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// HEADER_MAGIC starts the header block, it reads as "XLBD" on disk and is
+	// far too large to be mistaken for the data length of a node
+	HEADER_MAGIC = 0x44424c58
+	DB_VERSION   = BLOCK_SIZE_VERSION
+
+	// SEPARATE_VALUES_VERSION is the first format version with header flags
+	SEPARATE_VALUES_VERSION = 3
+	// HEADER_SEPARATE_VALUES is set in the header flags of a SeparateValues
+	// file
+	HEADER_SEPARATE_VALUES = 1
+
+	// KEY_ORDER_VERSION is the first format version with HEADER_KEY_ORDER,
+	// older versions would read such a file in the wrong order
+	KEY_ORDER_VERSION = 5
+	// HEADER_KEY_ORDER is set in the header flags of a file whose keys are
+	// ordered by a KeyOrder comparator
+	HEADER_KEY_ORDER = 2
+	// KEY_ORDER_NAME_VERSION is the first format version storing the name
+	// of the KeyOrder comparator after the flags
+	KEY_ORDER_NAME_VERSION = 7
+	// MAX_KEY_ORDER_NAME is the longest comparator name, its length is
+	// stored in a byte
+	MAX_KEY_ORDER_NAME = 255
+	// VALUES_GENERATION_VERSION is the first format version storing the
+	// generation of the SeparateValues side file after the comparator name,
+	// see valuesName
+	VALUES_GENERATION_VERSION = 8
+	// BLOCK_SIZE_VERSION is the first format version storing the block
+	// size after the generation, older files rely on the BlockSize option
+	BLOCK_SIZE_VERSION = 9
+)
+
+// header is stored at offset 0 and takes a whole block. Files written
+// before the header existed (version 0) start with a node instead.
+// on disk:
+// [magic][version][compression][flags][namelen uint8][name][generation uint32]
+// [block size uint32]
+// the comparator name is only there from KEY_ORDER_NAME_VERSION on, the
+// side file generation from VALUES_GENERATION_VERSION on and the block size
+// from BLOCK_SIZE_VERSION on.
+type header struct {
+	Version     uint8
+	Compression Compression
+	Flags       uint8
+}
+
+func (t *Tree) writeHeader() error {
+	h := header{
+		Version:     DB_VERSION,
+		Compression: t.compression,
+	}
+	if t.separateValues {
+		h.Flags |= HEADER_SEPARATE_VALUES
+	}
+	if t.less != nil {
+		h.Flags |= HEADER_KEY_ORDER
+		if t.lessName == "" || len(t.lessName) > MAX_KEY_ORDER_NAME {
+			return fmt.Errorf("%w: comparator name %q must have 1 to %d bytes", ErrorKeyOrderMismatch, t.lessName, MAX_KEY_ORDER_NAME)
+		}
+	}
+
+	bs := bytes.NewBuffer(make([]byte, 0))
+	if err := binary.Write(bs, binary.LittleEndian, uint32(HEADER_MAGIC)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(bs, binary.LittleEndian, h); err != nil {
+		return err
+	}
+
+	// the comparator name, empty without KeyOrder
+	name := ""
+	if t.less != nil {
+		name = t.lessName
+	}
+	bs.WriteByte(uint8(len(name)))
+	bs.WriteString(name)
+
+	if err := binary.Write(bs, binary.LittleEndian, t.valuesGen); err != nil {
+		return err
+	}
+
+	if err := binary.Write(bs, binary.LittleEndian, t.blockSize); err != nil {
+		return err
+	}
+
+	// the header takes a whole block
+	data := make([]byte, t.blockSize)
+	copy(data, bs.Bytes())
+	if err := t.writeAt(data, 0); err != nil {
+		return err
+	}
+
+	t.version = h.Version
+	t.dataOff = int64(t.blockSize)
+
+	return nil
+}
+
+// readHeader loads the header, files without one are version 0 and keep
+// their first node at offset 0
+func (t *Tree) readHeader() error {
+	buf := make([]byte, 4+binary.Size(header{})+1+MAX_KEY_ORDER_NAME+4+4)
+	n, err := t.file.ReadAt(buf, 0)
+	if n < 4 {
+		return fmt.Errorf("read header from %v: %w", t.file.Name(), err)
+	}
+
+	bs := bytes.NewBuffer(buf)
+	var magic uint32
+	if err := binary.Read(bs, binary.LittleEndian, &magic); err != nil {
+		return err
+	}
+
+	if magic != HEADER_MAGIC {
+		t.version = 0
+		t.dataOff = 0
+		t.compression = NoCompression
+		t.separateValues = false
+		t.valuesGen = 0
+		return t.checkKeyOrder(false, "")
+	}
+
+	var h header
+	if err := binary.Read(bs, binary.LittleEndian, &h); err != nil {
+		return ErrorInvalidDBFormat
+	}
+
+	if h.Version > DB_VERSION {
+		return fmt.Errorf("%w: version %d is newer than %d", ErrorInvalidDBFormat, h.Version, DB_VERSION)
+	}
+
+	t.version = h.Version
+	t.compression = h.Compression
+	// older headers are followed by padding, their flags read as 0
+	t.separateValues = h.Flags&HEADER_SEPARATE_VALUES != 0
+
+	stored := h.Flags&HEADER_KEY_ORDER != 0
+	name := ""
+	if h.Version >= KEY_ORDER_NAME_VERSION {
+		nameLen, err := bs.ReadByte()
+		if err != nil || int(nameLen) > bs.Len() {
+			return fmt.Errorf("%w: truncated comparator name", ErrorInvalidDBFormat)
+		}
+		name = string(bs.Next(int(nameLen)))
+	}
+
+	t.valuesGen = 0
+	if h.Version >= VALUES_GENERATION_VERSION {
+		if err := binary.Read(bs, binary.LittleEndian, &t.valuesGen); err != nil {
+			return fmt.Errorf("%w: truncated side file generation", ErrorInvalidDBFormat)
+		}
+	}
+
+	if h.Version >= BLOCK_SIZE_VERSION {
+		var blockSize uint32
+		if err := binary.Read(bs, binary.LittleEndian, &blockSize); err != nil || blockSize == 0 {
+			return fmt.Errorf("%w: truncated block size", ErrorInvalidDBFormat)
+		}
+		if t.blockSizeSet && blockSize != t.blockSize {
+			return fmt.Errorf("%w: %v has blocks of %d bytes, not %d", ErrorBlockSizeMismatch, t.file.Name(), blockSize, t.blockSize)
+		}
+		t.blockSize = blockSize
+	}
+	t.dataOff = int64(t.blockSize)
+
+	return t.checkKeyOrder(stored, name)
+}
+
+// checkKeyOrder fails unless the file was written with a KeyOrder
+// comparator exactly when t has one, and under the same name. Files older
+// than KEY_ORDER_NAME_VERSION have no name, name is then empty and any
+// comparator is taken.
+func (t *Tree) checkKeyOrder(stored bool, name string) error {
+	switch {
+	case stored && t.less == nil:
+		return fmt.Errorf("%w: %v was written with KeyOrder %q, open it with NewTreeCmp", ErrorKeyOrderMismatch, t.file.Name(), name)
+	case !stored && t.less != nil:
+		return fmt.Errorf("%w: %v is in ascending key order", ErrorKeyOrderMismatch, t.file.Name())
+	case stored && name != "" && name != t.lessName:
+		return fmt.Errorf("%w: %v was written with KeyOrder %q, not %q", ErrorKeyOrderMismatch, t.file.Name(), name, t.lessName)
+	}
+
+	return nil
+}
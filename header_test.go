@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "header.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if tree.version != DB_VERSION || tree.dataOff != int64(tree.blockSize) {
+		t.Fatalf("got version %d, data at %d", tree.version, tree.dataOff)
+	}
+	if tree.rootOff < tree.dataOff {
+		t.Fatalf("root at %d overlaps the header", tree.rootOff)
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func TestHeaderlessFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "v0.db")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a version 0 file keeps its first node at offset 0
+	old := &Tree{file: fileStore{file}, blockSize: BLOCK_SIZE}
+	leaf := &Node{
+		IsActive: true,
+		IsLeaf:   true,
+		Self:     0,
+		Next:     INVALID_OFFSET,
+		Prev:     INVALID_OFFSET,
+		Parent:   INVALID_OFFSET,
+		Keys:     []int64{1, 2},
+		Values:   []string{"test1", "test2"},
+	}
+	if err := old.flushNodeToDisk(leaf); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if tree.version != 0 || tree.dataOff != 0 {
+		t.Fatalf("got version %d, data at %d", tree.version, tree.dataOff)
+	}
+	if val, err := tree.Find(2); err != nil || val != "test2" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	if err := tree.Insert(3, "test3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMisalignedFileSize(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "misaligned.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fstat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fstat.Size()
+	if size%BLOCK_SIZE != 0 {
+		t.Fatalf("file size %d is not block aligned", size)
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(make([]byte, 13)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, err := NewTree(filename); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+
+	tree, err = NewTree(filename, RepairOnOpen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if fstat, err = os.Stat(filename); err != nil {
+		t.Fatal(err)
+	}
+	if fstat.Size()%BLOCK_SIZE != 0 || fstat.Size() < size {
+		t.Fatalf("expected the file to be truncated back to %d, got %d", size, fstat.Size())
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+}
+
+func TestHeaderBlockNeverAllocated(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "header.db")
+	tree, err := NewTree(filename, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for _, off := range tree.freeBlocks {
+			if off < tree.dataOff {
+				t.Fatalf("free list holds %d, inside the header", off)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			node, err := tree.newNodeFromDisk()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node.Self < tree.dataOff {
+				t.Fatalf("node allocated at %d, inside the header", node.Self)
+			}
+			tree.freeBlocks = append(tree.freeBlocks, node.Self)
+		}
+	}
+
+	check()
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 200; i += 2 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+
+	// the scans on open start after the header too
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewTree(filename, MinPrealloc(1)); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if tree.dataOff != BLOCK_SIZE || tree.rootOff < tree.dataOff {
+		t.Fatalf("data at %d, root at %d", tree.dataOff, tree.rootOff)
+	}
+	check()
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// v1Fixture is testdata/v1.db, a file of format version 1 written before
+// overflow pages, every node and value fits in its block. It must never be
+// regenerated with the current code, only with a checkout of version 1.
+const v1Fixture = "v1.db"
+
+func v1Value(key int64) string {
+	return fmt.Sprintf("v1-%d", key)
+}
+
+func TestOpenV1File(t *testing.T) {
+	// opening may write, work on a copy
+	data, err := ioutil.ReadFile(filepath.Join("testdata", v1Fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), v1Fixture)
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if tree.version != 1 {
+		t.Fatalf("got version %d, expected 1", tree.version)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 40 {
+		t.Fatalf("got %d keys, expected 40", len(keys))
+	}
+	for i, key := range keys {
+		if key != int64(i+1) {
+			t.Fatalf("got key %d at %d", key, i)
+		}
+		if val, err := tree.Find(key); err != nil || val != v1Value(key) {
+			t.Fatalf("got %q, %v for key %d", val, err, key)
+		}
+	}
+
+	// without overflow pages a value must still fit in its leaf
+	big := strings.Repeat("x", tree.overflowThreshold())
+	if err := tree.Insert(41, big); !errors.Is(err, ErrorValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrorValueTooLarge, err)
+	}
+	if err := tree.Insert(41, v1Value(41)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
+
+// IsEmpty tells if the tree holds no key. It reads nothing from disk, a
+// tree whose last key was deleted has no root left.
+func (t *Tree) IsEmpty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.rootOff == INVALID_OFFSET
+}
+
+// Height returns the number of levels in the tree, 0 for an empty tree
+// and 1 for a tree made of a single leaf. It only walks down the leftmost
+// path since every leaf is at the same depth.
+func (t *Tree) Height() (_ int, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return 0, nil
+	}
+
+	node, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return 0, err
+	}
+
+	height := 1
+	for !node.IsLeaf {
+		if node, err = t.seekNode(node.child(0)); err != nil {
+			return 0, err
+		}
+		height++
+	}
+
+	return height, nil
+}
+
+// LeafDepthRange returns the depths of the shallowest and the deepest
+// leaf, with 0 being the root. Unlike Height it walks every node, so a
+// tree whose leaves are not all at the same depth shows min < max.
+func (t *Tree) LeafDepthRange() (min, max int, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return 0, 0, nil
+	}
+
+	min = -1
+	level := []int64{t.rootOff}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []int64
+		for _, off := range level {
+			node, err := t.seekNodeKeys(off)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if !node.IsLeaf {
+				next = append(next, node.Children...)
+				continue
+			}
+
+			if min < 0 {
+				min = depth
+			}
+			max = depth
+		}
+		level = next
+	}
+
+	return min, max, nil
+}
+
+// LevelKeys returns the keys of every node at the given depth, left to
+// right, with 0 being the root. Internal keys are the separators, each one
+// the largest key below the matching child.
+func (t *Tree) LevelKeys(level int) (_ [][]int64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if level < 0 || t.rootOff == INVALID_OFFSET {
+		return nil, fmt.Errorf("level %d does not exist", level)
+	}
+
+	node, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []*Node{node}
+	for depth := 0; depth < level; depth++ {
+		if nodes[0].IsLeaf {
+			return nil, fmt.Errorf("level %d is below the leaves at level %d", level, depth)
+		}
+
+		var below []*Node
+		for _, n := range nodes {
+			for _, off := range n.Children {
+				child, err := t.seekNode(off)
+				if err != nil {
+					return nil, err
+				}
+				below = append(below, child)
+			}
+		}
+		nodes = below
+	}
+
+	keys := make([][]int64, 0, len(nodes))
+	for _, n := range nodes {
+		keys = append(keys, n.Keys)
+	}
+
+	return keys, nil
+}
+
+// LeafOffsetFor returns the offset of the leaf a lookup of key ends in,
+// whether the key is there or not
+func (t *Tree) LeafOffsetFor(key int64) (_ int64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return INVALID_OFFSET, ErrorNotFoundKey
+	}
+
+	leaf, err := t.findLeafNode(key)
+	if err != nil {
+		return INVALID_OFFSET, err
+	}
+
+	return leaf.Self, nil
+}
+
+// KeyLocations maps every key to the offset of the leaf holding it, as
+// LeafOffsetFor would give, in a single walk of the leaf chain
+func (t *Tree) KeyLocations() (_ map[int64]int64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	locs := make(map[int64]int64)
+	if t.rootOff == INVALID_OFFSET {
+		return locs, nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		for _, key := range leaf.Keys {
+			locs[key] = leaf.Self
+		}
+
+		if leaf.Next == INVALID_OFFSET {
+			return locs, nil
+		}
+
+		if leaf, err = t.seekNodeKeys(leaf.Next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// EachActiveNode calls fn for every active node in file offset order,
+// which is handy when debugging the physical layout. Iteration stops at
+// the first error returned by fn. fn must not modify the tree.
+func (t *Tree) EachActiveNode(fn func(off int64, n *Node) error) (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	return t.eachBlock(func(off int64, node *Node) error {
+		if !node.IsActive || node.overflowPage {
+			return nil
+		}
+		return fn(off, node)
+	})
+}
+
+// SpaceInfo counts the blocks of the file holding data, nodes and overflow
+// pages, and the free ones, next to the total. Many free blocks against
+// few active ones mean Compact would shrink the file a lot.
+func (t *Tree) SpaceInfo() (active int, free int, fileBlocks int, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	err = t.eachBlock(func(off int64, node *Node) error {
+		if node.IsActive {
+			active++
+		} else {
+			free++
+		}
+		fileBlocks++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return active, free, fileBlocks, nil
+}
+
+// Fragmentation returns free / (active + free) as counted by SpaceInfo,
+// from 0 for a file without free blocks to 1 for a file with nothing but.
+// Free blocks reserved ahead by MinPrealloc count as well, so a small tree
+// starts well above 0. A high value means Compact would shrink the file.
+func (t *Tree) Fragmentation() (float64, error) {
+	_, free, fileBlocks, err := t.SpaceInfo()
+	if err != nil || fileBlocks == 0 {
+		return 0, err
+	}
+
+	return float64(free) / float64(fileBlocks), nil
+}
+
+// eachBlock calls fn for every block after the header in file offset order
+func (t *Tree) eachBlock(fn func(off int64, n *Node) error) error {
+	size, err := t.storedSize()
+	if err != nil {
+		return err
+	}
+
+	for off := t.dataOff; off < size; off += int64(t.blockSize) {
+		node, err := t.seekNode(off)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(off, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fingerprint hashes every key and value in ascending key order with
+// 64-bit FNV-1a. It only depends on the content, so two databases holding
+// the same pairs share a fingerprint whatever their layout.
+func (t *Tree) Fingerprint() (_ uint64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	h := fnv.New64a()
+	if t.rootOff == INVALID_OFFSET {
+		return h.Sum64(), nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 12)
+	for {
+		for i, key := range leaf.Keys {
+			binary.LittleEndian.PutUint64(buf, uint64(key))
+			val := leaf.value(i)
+			binary.LittleEndian.PutUint32(buf[8:], uint32(len(val)))
+			h.Write(buf)
+			h.Write([]byte(val))
+		}
+
+		if leaf.Next == INVALID_OFFSET {
+			return h.Sum64(), nil
+		}
+
+		if leaf, err = t.seekNode(leaf.Next); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// DistinctValues counts the different values in the tree. It keeps every
+// distinct value in memory while walking the leaves, so on a large
+// database with mostly unique values it needs about as much memory as the
+// values themselves.
+func (t *Tree) DistinctValues() (_ int, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	seen := make(map[string]struct{})
+	err = t.ascendAll(func(key int64, val string) bool {
+		seen[val] = struct{}{}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(seen), nil
+}
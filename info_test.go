@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeight(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "height.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if h, err := tree.Height(); err != nil || h != 0 {
+		t.Fatalf("empty tree: got %d, %v", h, err)
+	}
+
+	last := 0
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := tree.Height()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && h != 1 {
+			t.Fatalf("single leaf: got height %d", h)
+		}
+		if h < last {
+			t.Fatalf("height dropped from %d to %d after inserting %d", last, h, i)
+		}
+		last = h
+	}
+
+	if last < 3 {
+		t.Fatalf("expected at least 3 levels for 100 keys with order %d, got %d", tree.order, last)
+	}
+}
+
+func TestEachActiveNode(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "each.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// delete a whole leaf worth of keys so some blocks become inactive
+	for i := int64(1); i <= 10; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// count the nodes reachable from the root
+	reachable := 0
+	queue := []int64{tree.rootOff}
+	for len(queue) != 0 {
+		node, err := tree.seekNode(queue[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue = append(queue[1:], node.Children...)
+		reachable++
+	}
+
+	active := 0
+	last := int64(-1)
+	err = tree.EachActiveNode(func(off int64, n *Node) error {
+		if off <= last {
+			t.Fatalf("offset %d visited after %d", off, last)
+		}
+		if n.Self != off {
+			t.Fatalf("node at %d claims to be at %d", off, n.Self)
+		}
+		last = off
+		active++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active != reachable {
+		t.Fatalf("visited %d active nodes, %d reachable from root", active, reachable)
+	}
+}
+
+func TestLevelKeys(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "levels.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 30; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	height, err := tree.Height()
+	if err != nil || height < 3 {
+		t.Fatalf("expected at least 3 levels, got %d, %v", height, err)
+	}
+
+	root, err := tree.LevelKeys(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) != 1 {
+		t.Fatalf("expected a single root, got %v", root)
+	}
+
+	// the leaves hold every key in order
+	leaves, err := tree.LevelKeys(height - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := int64(1)
+	for _, keys := range leaves {
+		for _, key := range keys {
+			if key != want {
+				t.Fatalf("expected key %d, got %d in %v", want, key, leaves)
+			}
+			want++
+		}
+	}
+	if want != 31 {
+		t.Fatalf("leaves end at %d: %v", want-1, leaves)
+	}
+
+	if _, err := tree.LevelKeys(height); err == nil {
+		t.Fatal("expected an error below the leaves")
+	}
+}
+
+func TestLeafOffsetFor(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "leafoff.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if _, err := tree.LeafOffsetFor(1); err != ErrorNotFoundKey {
+		t.Fatalf("empty tree: expected %v, got %v", ErrorNotFoundKey, err)
+	}
+
+	for i := int64(1); i <= int64(tree.order); i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last key fits, the next one splits the leaf between them
+	last := int64(tree.order)
+	before, err := tree.LeafOffsetFor(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(last+1, "split"); err != nil {
+		t.Fatal(err)
+	}
+
+	left, err := tree.LeafOffsetFor(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := tree.LeafOffsetFor(last + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != before || left == right {
+		t.Fatalf("keys %d and %d map to %d and %d, %d before the split", last, last+1, left, right, before)
+	}
+
+	// a missing key past the end still routes to the last leaf
+	if off, err := tree.LeafOffsetFor(1000); err != nil || off != right {
+		t.Fatalf("got %d, %v, expected %d", off, err, right)
+	}
+}
+
+func TestKeyLocations(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "locations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if locs, err := tree.KeyLocations(); err != nil || len(locs) != 0 {
+		t.Fatalf("empty tree: got %v, %v", locs, err)
+	}
+
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 200; i += 4 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locs, err := tree.KeyLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 150 {
+		t.Fatalf("expected 150 keys, got %d", len(locs))
+	}
+
+	for key, off := range locs {
+		leaf, err := tree.seekNode(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, k := range leaf.Keys {
+			found = found || k == key
+		}
+		if !leaf.IsLeaf || !found {
+			t.Fatalf("key %d maps to %d holding %v", key, off, leaf.Keys)
+		}
+	}
+}
+
+func TestSpaceInfo(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "space.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 40; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	active, free, fileBlocks, err := tree.SpaceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fstat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int((fstat.Size() - tree.dataOff) / BLOCK_SIZE); fileBlocks != want {
+		t.Fatalf("got %d blocks, the file has %d", fileBlocks, want)
+	}
+	if active+free != fileBlocks {
+		t.Fatalf("%d active + %d free != %d blocks", active, free, fileBlocks)
+	}
+	if free != len(tree.freeBlocks) {
+		t.Fatalf("got %d free blocks, the free list has %d", free, len(tree.freeBlocks))
+	}
+
+	nodes := 0
+	if err := tree.EachActiveNode(func(off int64, n *Node) error {
+		nodes++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if active != nodes {
+		t.Fatalf("got %d active blocks, expected %d nodes", active, nodes)
+	}
+}
+
+func TestLeafDepthRange(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "depth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if min, max, err := tree.LeafDepthRange(); err != nil || min != 0 || max != 0 {
+		t.Fatalf("empty tree: got %d, %d, %v", min, max, err)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 100; i += 3 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	height, err := tree.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height < 3 {
+		t.Fatalf("expected at least 3 levels, got %d", height)
+	}
+
+	min, max, err := tree.LeafDepthRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if min != height-1 || max != height-1 {
+		t.Fatalf("got leaves between depth %d and %d, expected %d", min, max, height-1)
+	}
+
+	// hang the first leaf straight under the root
+	leaf, err := tree.firstLeafNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Children[0] = leaf.Self
+	if err := tree.flushNodeToDisk(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if min, max, err = tree.LeafDepthRange(); err != nil || min != 1 || max != height-1 {
+		t.Fatalf("got %d, %d, %v, expected 1, %d", min, max, err, height-1)
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "distinct.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if n, err := tree.DistinctValues(); err != nil || n != 0 {
+		t.Fatalf("empty tree: got %d, %v", n, err)
+	}
+
+	// 7 different values over 100 keys
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("value%d", i%7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := tree.DistinctValues(); err != nil || n != 7 {
+		t.Fatalf("got %d, %v, expected 7", n, err)
+	}
+
+	if err := tree.Update(50, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tree.DistinctValues(); err != nil || n != 8 {
+		t.Fatalf("got %d, %v, expected 8", n, err)
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "frag.db"), MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if frag, err := tree.Fragmentation(); err != nil || frag != 0 {
+		t.Fatalf("got %v, %v on an empty file", frag, err)
+	}
+
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := tree.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 150; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := tree.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after <= before || after > 1 {
+		t.Fatalf("got %v after deletes, %v before", after, before)
+	}
+}
@@ -5,13 +5,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sort"
+	"sync"
+	"time"
 )
 
-var order = 4
-
 const (
+	ORDER          = 4 // max keys in a node before it splits, unless Order is given
 	INVALID_OFFSET = 0xdeadbeef
 	MAX_FREEBLOCKS = 100
 	BLOCK_SIZE     = 4096 // it should call syscall to find the filesystem block size, but i dont know which syscall on windows
@@ -20,18 +22,107 @@ const (
 var ErrorHasExistedKey = errors.New("hasExistedKey")
 var ErrorNotFoundKey = errors.New("notFoundKey")
 var ErrorInvalidDBFormat = errors.New("invalid db format")
+var ErrorNilNode = errors.New("nil node")
+var ErrorTreeNotInitialized = errors.New("tree not initialized")
+var ErrorShortRead = errors.New("short read")
+var ErrorOffsetOutOfRange = errors.New("offset out of range")
+var ErrorNodeTooLarge = errors.New("node too large")
+var ErrorValueTooLarge = errors.New("value too large")
+var ErrorKeyOrderMismatch = errors.New("key order mismatch")
+var ErrorBlockSizeMismatch = errors.New("block size mismatch")
 
 type Tree struct {
-	file       *os.File
+	reads int64 // readAt calls, updated atomically so first for alignment
+
+	mu         sync.RWMutex
+	file       BlockStore
 	blockSize  uint32
 	fileSize   int64
 	rootOff    int64
 	freeBlocks []int64
+	prealloc   int // how many free blocks to reserve ahead
+	scanLimit  int // how many blocks at the end are scanned for free ones, 0 for all
+	order      int // max keys in a node
+
+	blockSizeSet    bool        // BlockSize was passed, a stored block size has to agree
+	debugInvariants bool        // check nodes before they are written
+	strictReads     bool        // check nodes as they are read
+	uniqueValues    bool        // reject a value already stored under another key
+	zeroOnFree      bool        // overwrite the whole block when it is freed
+	rebuildOnOpen   bool        // rebuild internal nodes from the leaves if broken
+	repairOnOpen    bool        // drop a partial block at the end of the file
+	fileMode        os.FileMode // permissions of a file created by NewTree
+	keyValidator    func(key int64) error
+	maxValueSize    int                   // largest value accepted, 0 for the file's own limit
+	expertMode      bool                  // ReadNode and WriteNode are allowed
+	less            func(a, b int64) bool // key order of KeyOrder, nil for ascending
+	lessName        string                // name of less, kept in the header
+
+	version     uint8       // on-disk format version, see header
+	dataOff     int64       // offset of the first node block
+	compression Compression // how values are compressed on disk
+	valuesGen   uint32      // generation of the side file, see valuesName
+
+	coalesceLimit int              // max dirty blocks buffered, 0 to write through
+	manualFlush   bool             // SetAutoFlush(false), blocks wait for Flush
+	dirty         map[int64][]byte // encoded blocks not written yet
+	writes        int64            // WriteAt calls issued
+	leafSplits    int64            // leaves split by inserts
+
+	valueKeys map[string]int64 // the key of every value, UniqueValues only
+
+	useMmap bool   // serve reads from a mapping of the file
+	mapped  []byte // read-only mapping of the file, nil if not mapped
+
+	separateValues bool       // leaf values live in a side file
+	vals           BlockStore // the side file of SeparateValues
+	valsSize       int64      // where the next value goes in the side file
+
+	syncInterval time.Duration // how often the sync loop runs, 0 for never
+	syncStop     chan struct{} // closed to stop the sync loop
+	syncDone     chan struct{} // closed once the sync loop returned
+	syncErr      error         // first error of the sync loop
 }
 
 // Node defines the node structure
-// on disk:
-// [datalen][...]
+// on disk, every integer is little endian:
+// [datalen uint32]
+// [type uint8][isleaf uint8]
+// [self int64][next int64][prev int64][parent int64]
+// [childcnt int64][child int64]...[count int64]...
+// [keyscnt int64][key int64]...
+// [valuescnt int64]([vallen uint32][val])...
+// datalen counts the bytes after itself, booleans are 0 or 1, and each val
+// starts with a compression tag byte if the header enables compression.
+// type tells what the block holds, see BLOCK_FREE and the others, and can
+// be read without decoding the rest; before BLOCK_TYPE_VERSION it was the
+// isactive boolean. The counts, one per child, tell how many keys are
+// under each child; only BLOCK_COUNTED nodes have them.
+// A val too large to stay in the leaf is stored as
+// [vallen|OVERFLOW_FLAG uint32][first page int64] instead, its bytes living
+// in overflow pages whose type byte is OVERFLOW_PAGE. With
+// SeparateValues every val is stored that way, the offset pointing into
+// the side file instead.
+const (
+	// BLOCK_FREE and BLOCK_NODE are the type bytes of a free block and of a
+	// node, leaf or not, the isactive boolean of older versions
+	BLOCK_FREE = 0
+	BLOCK_NODE = 1
+	// BLOCK_LEAF and BLOCK_INTERNAL replace BLOCK_NODE from
+	// BLOCK_TYPE_VERSION on; OVERFLOW_PAGE is the last type
+	BLOCK_LEAF     = 3
+	BLOCK_INTERNAL = 4
+	// BLOCK_COUNTED is an internal node with the key counts of its children,
+	// it replaces BLOCK_INTERNAL from SUBTREE_COUNT_VERSION on
+	BLOCK_COUNTED = 5
+	// BLOCK_TYPE_VERSION is the first format version with leaf and
+	// internal node types
+	BLOCK_TYPE_VERSION = 4
+	// SUBTREE_COUNT_VERSION is the first format version keeping key counts
+	// in the internal nodes, see Rank and Select
+	SUBTREE_COUNT_VERSION = 6
+)
+
 type Node struct {
 	IsActive bool // determine if this node on disk is valid for the tree
 	IsLeaf   bool
@@ -40,68 +131,264 @@ type Node struct {
 	Prev     int64
 	Parent   int64
 	Children []int64 // record children's offset
+	Counts   []int64 // keys under each child, BLOCK_COUNTED nodes only
 	Keys     []int64
 	Values   []string
+
+	overflow     map[int64]overflowRef // values kept out of the leaf, by key
+	overflowPage bool                  // the block is an overflow page, not a node
+	partial      bool                  // read without its out of line values
 }
 
-func NewTree(filename string) (*Tree, error) {
-	t := &Tree{}
+func NewTree(filename string, opts ...Option) (*Tree, error) {
+	// only the file mode is needed before the file exists
+	cfg := &Tree{fileMode: 0644}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, cfg.fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return openedTree(file, opts...)
+}
+
+// NewTreeCmp is NewTree with the keys ordered by less under the given
+// name, see KeyOrder
+func NewTreeCmp(filename string, name string, less func(a, b int64) bool, opts ...Option) (*Tree, error) {
+	return NewTree(filename, append(opts, KeyOrder(name, less))...)
+}
+
+// OpenExisting is NewTree for tools that must never create a database: it
+// fails with an error wrapping os.ErrNotExist if filename does not exist.
+func OpenExisting(filename string, opts ...Option) (*Tree, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return openedTree(file, opts...)
+}
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+// openedTree is NewTreeFromFile for the constructors opening file
+// themselves, it closes file when the tree cannot be built on it
+func openedTree(file *os.File, opts ...Option) (*Tree, error) {
+	t, err := NewTreeFromFile(file, opts...)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
-	t.file = file
+
+	return t, nil
+}
+
+// NewTreeFromFile builds the tree on an already opened file, which must be
+// readable and writable. The tree takes ownership of the file and closes it
+// on Close. On failure the file is left open, closing it is up to the
+// caller.
+func NewTreeFromFile(file *os.File, opts ...Option) (*Tree, error) {
+	return NewTreeFromStore(fileStore{file}, opts...)
+}
+
+// NewTreeFromStore builds the tree on any BlockStore. The tree takes
+// ownership of the store and closes it on Close. UseMmap and Compact only
+// work on files. On failure the store is left open, closing it is up to
+// the caller; the side file of SeparateValues is closed.
+func NewTreeFromStore(store BlockStore, opts ...Option) (_ *Tree, err error) {
+	t := &Tree{}
+	t.file = store
+
+	// runs after recoverCorrupt, which may set err
+	defer func() {
+		if err != nil {
+			t.unmap()
+			t.closeValues()
+		}
+	}()
+	defer recoverCorrupt(&err)
 
 	// var stat syscall.Statfs_t
 	// if err = syscall.Statfs(filename, &stat); err != nil {
 	// 	return nil, err
 	// }
-	t.rootOff = INVALID_OFFSET
 	t.blockSize = BLOCK_SIZE
+	t.prealloc = MAX_FREEBLOCKS
+	t.order = ORDER
+	t.fileMode = 0644
 
-	fstat, err := t.file.Stat()
-	if err != nil {
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if err := t.load(); err != nil {
 		return nil, err
 	}
 
-	t.fileSize = fstat.Size()
+	if t.syncInterval > 0 {
+		t.startSyncLoop()
+	}
+
+	return t, nil
+}
+
+// load rebuilds the in-memory state from t.file
+func (t *Tree) load() error {
+	t.rootOff = INVALID_OFFSET
+	t.freeBlocks = nil
+	t.dirty = nil
+	t.valueKeys = nil
+
+	if err := t.unmap(); err != nil {
+		return err
+	}
+
+	size, err := t.file.Size()
+	if err != nil {
+		return err
+	}
+
+	t.fileSize = size
+
+	// brand new file
+	if t.fileSize == 0 {
+		if err = t.writeHeader(); err != nil {
+			return err
+		}
+		t.fileSize = t.dataOff
+		return t.openValues()
+	}
+
+	if err = t.readHeader(); err != nil {
+		return err
+	}
+
+	if err = t.openValues(); err != nil {
+		return err
+	}
+
+	// files with a header only grow by whole blocks, a partial block at
+	// the end comes from a crash or an external truncation
+	if tail := t.fileSize % int64(t.blockSize); t.version > 0 && tail != 0 {
+		if !t.repairOnOpen {
+			return fmt.Errorf("%w: file size %d is not a multiple of the block size %d", ErrorInvalidDBFormat, t.fileSize, t.blockSize)
+		}
+
+		t.fileSize -= tail
+		if err = t.file.Truncate(t.fileSize); err != nil {
+			return err
+		}
+	}
 
 	// already has file content
-	if t.fileSize != 0 {
-		if err = t.reconstructRootNode(); err != nil {
-			return nil, err
+	if t.fileSize > t.dataOff {
+		rootErr := t.reconstructRootNode()
+		if rootErr != nil && !t.rebuildOnOpen {
+			return rootErr
 		}
 
-		if err = t.allocNewFreeNodeInDisk(); err != nil {
-			return nil, err
+		if err = t.scanFreeBlocks(); err != nil {
+			return err
+		}
+
+		if t.rebuildOnOpen && (rootErr != nil || t.verify() != nil) {
+			// a crash in the middle of a split only needs the new leaf
+			// linked into its parent, anything else is rebuilt
+			relinked := false
+			if rootErr == nil {
+				_, err := t.relinkSplitLeaves()
+				relinked = err == nil && t.verify() == nil
+			}
+
+			if !relinked {
+				if err = t.rebuildFromLeaves(); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
-	return t, nil
+	return t.loadValueKeys()
+}
+
+// Reopen writes out any buffered blocks and reloads the tree from the file,
+// picking up changes made to it by another handle since it was opened.
+func (t *Tree) Reopen() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	if err := t.flushDirty(); err != nil {
+		return err
+	}
+
+	return t.load()
+}
+
+// Close closes the underlying db file
+func (t *Tree) Close() error {
+	t.stopSyncLoop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.flushDirty(); err != nil {
+		t.unmap()
+		t.closeValues()
+		t.file.Close()
+		return err
+	}
+
+	if err := t.unmap(); err != nil {
+		t.file.Close()
+		return err
+	}
+
+	if err := t.closeValues(); err != nil {
+		t.file.Close()
+		return err
+	}
+
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+
+	return t.syncErr
 }
 
 func (t *Tree) reconstructRootNode() error {
 
 	var node *Node
 	var err error
-	// find first valid node
-	for off := int64(0); off < t.fileSize; off += int64(t.blockSize) {
-		if node, err = t.seekNode(off); err != nil {
+	// find first valid node, free blocks and overflow pages are skipped by
+	// their type alone
+	for off := t.dataOff; off < t.fileSize; off += int64(t.blockSize) {
+		kind, err := t.readBlockType(off)
+		if err != nil {
 			return err
 		}
-		if node.IsActive {
-			break
+		if kind == BLOCK_FREE || kind == OVERFLOW_PAGE {
+			continue
+		}
+
+		if node, err = t.seekNode(off); err != nil {
+			return err
 		}
+		break
 	}
-	if !node.IsActive {
-		return ErrorInvalidDBFormat
+	// every key has been deleted, the tree is empty
+	if node == nil {
+		return nil
 	}
 	// the root node's parent is invalid
 	for node.Parent != INVALID_OFFSET {
 		if node, err = t.seekNode(node.Parent); err != nil {
 			return err
 		}
+		if !node.IsActive {
+			return ErrorInvalidDBFormat
+		}
 	}
 
 	t.rootOff = node.Self
@@ -109,30 +396,124 @@ func (t *Tree) reconstructRootNode() error {
 	return nil
 }
 
-func (t *Tree) allocNewFreeNodeInDisk() error {
+// scanFreeBlocks fills the free list with the inactive blocks of the file,
+// only the last scanLimit blocks if it is set. It reserves nothing ahead,
+// so merely opening a database leaves the file as it is until a write needs
+// a new block.
+func (t *Tree) scanFreeBlocks() error {
+	blockSize := int64(t.blockSize)
+	start := t.dataOff
+	if limit := int64(t.scanLimit) * blockSize; limit > 0 && t.fileSize-limit > start {
+		start = t.fileSize - limit
+		start -= (start - t.dataOff) % blockSize
+	}
 
-	for off := int64(0); off < t.fileSize; off += BLOCK_SIZE {
-		node, err := t.seekNode(off)
+	for off := start; off < t.fileSize; off += blockSize {
+		kind, err := t.readBlockType(off)
 		if err != nil {
 			return err
 		}
-		// is inactive == freeblock
-		if !node.IsActive {
+		if kind == BLOCK_FREE {
 			t.freeBlocks = append(t.freeBlocks, off)
 		}
 	}
 
-	next_file := ((t.fileSize + 4095) / 4096) * 4096
-	for len(t.freeBlocks) < MAX_FREEBLOCKS {
+	return t.remap()
+}
+
+// allocNewFreeNodeInDisk grows the file to reserve blocks ahead until the
+// free list holds prealloc of them. Blocks freed since the file was opened
+// are already in the list, so the file is not scanned again.
+func (t *Tree) allocNewFreeNodeInDisk() error {
+
+	blockSize := int64(t.blockSize)
+	next_file := ((t.fileSize + blockSize - 1) / blockSize) * blockSize
+	// the list may already hold blocks past fileSize, new ones go after them
+	for _, off := range t.freeBlocks {
+		if off+blockSize > next_file {
+			next_file = off + blockSize
+		}
+	}
+	for len(t.freeBlocks) < t.prealloc {
 		t.freeBlocks = append(t.freeBlocks, next_file)
-		next_file += BLOCK_SIZE
+		next_file += blockSize
+	}
+
+	// reserve the blocks in the file too, so its size stays block aligned
+	if err := t.file.Truncate(next_file); err != nil {
+		return err
 	}
 	t.fileSize = next_file
 
+	return t.remap()
+}
+
+// TrimTail truncates the free blocks at the end of the file away, such as
+// the ones reserved ahead by MinPrealloc. Free blocks in the middle of the
+// file stay, Compact gets rid of those. The file grows again as soon as
+// new blocks are needed.
+func (t *Tree) TrimTail() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// a pending write past the new end would grow the file back
+	if err := t.flushDirty(); err != nil {
+		return err
+	}
+
+	free := make(map[int64]bool, len(t.freeBlocks))
+	for _, off := range t.freeBlocks {
+		free[off] = true
+	}
+
+	size := t.fileSize
+	for size > t.dataOff && free[size-int64(t.blockSize)] {
+		size -= int64(t.blockSize)
+		delete(free, size)
+	}
+
+	if size == t.fileSize {
+		return nil
+	}
+
+	blocks := t.freeBlocks[:0]
+	for _, off := range t.freeBlocks {
+		if off < size {
+			blocks = append(blocks, off)
+		}
+	}
+	t.freeBlocks = blocks
+
+	if err := t.file.Truncate(size); err != nil {
+		return err
+	}
+	t.fileSize = size
+
+	return t.remap()
+}
+
+// DefragFreeList sorts the free blocks so that new nodes are handed out at
+// increasing offsets, turning scattered frees back into sequential writes
+func (t *Tree) DefragFreeList() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sort.Slice(t.freeBlocks, func(i, j int) bool { return t.freeBlocks[i] < t.freeBlocks[j] })
+
 	return nil
 }
 
 func (t *Tree) seekNode(off int64) (*Node, error) {
+	return t.decodeNode(off, true)
+}
+
+// seekNodeKeys is seekNode without reading the values kept out of the
+// leaf, the node comes back partial and must not be written
+func (t *Tree) seekNodeKeys(off int64) (*Node, error) {
+	return t.decodeNode(off, false)
+}
+
+func (t *Tree) decodeNode(off int64, withValues bool) (*Node, error) {
 	node := &Node{
 		IsActive: false,
 		Self:     INVALID_OFFSET,
@@ -141,112 +522,167 @@ func (t *Tree) seekNode(off int64) (*Node, error) {
 		Parent:   INVALID_OFFSET,
 	}
 
-	buf := make([]byte, 8)
-	if n, err := t.file.ReadAt(buf, off); err != nil {
+	buf, err := t.readBlock(off)
+	if err != nil {
 		return nil, err
-	} else if n != 8 {
-		return nil, fmt.Errorf("read at %v from %v, expect len = %v but got %v", off, t.file.Name(), 8, n)
 	}
 
-	bs := bytes.NewBuffer(buf)
-	var dataLen uint32
-	if err := binary.Read(bs, binary.LittleEndian, &dataLen); err != nil {
-		return nil, err
+	dataLen := binary.LittleEndian.Uint32(buf)
+
+	// a block never written or wiped out, nothing lives there
+	if dataLen == 0 {
+		return node, nil
 	}
 
-	if dataLen+8 > t.blockSize {
-		return nil, fmt.Errorf("node length invalid: %v, the block size is %v", dataLen, t.blockSize)
+	if dataLen > t.blockSize-8 {
+		return nil, fmt.Errorf("%w: node at %v has length %v, the block size is %v", ErrorNodeTooLarge, off, dataLen, t.blockSize)
 	}
 
-	buf = make([]byte, dataLen)
-	if n, err := t.file.ReadAt(buf, off+4); err != nil {
-		return nil, err
-	} else if n != int(dataLen) {
-		return nil, fmt.Errorf("read at %v from %v, expect len = %v but got %v", off, t.file.Name(), 8, n)
+	// part of a spilled value, read along with the leaf owning it
+	if buf[4] == OVERFLOW_PAGE {
+		node.IsActive = true
+		node.Self = off
+		node.overflowPage = true
+		return node, nil
 	}
 
-	bs = bytes.NewBuffer(buf)
+	if int(dataLen)+4 > len(buf) {
+		return nil, fmt.Errorf("%w: read at %v from %v, expect len = %v but got %v", ErrorShortRead, off, t.file.Name(), dataLen+4, len(buf))
+	}
 
-	// isactive
-	if err := binary.Read(bs, binary.LittleEndian, &node.IsActive); err != nil {
-		return nil, err
+	err = node.decode(buf[4:4+dataLen], func(bs *bytes.Buffer, i int) error {
+		var strLen uint32
+		if err := binary.Read(bs, binary.LittleEndian, &strLen); err != nil {
+			return err
+		}
+
+		var strBytes []byte
+		var ref *overflowRef
+		if strLen&OVERFLOW_FLAG != 0 {
+			var first int64
+			if err := binary.Read(bs, binary.LittleEndian, &first); err != nil {
+				return err
+			}
+			if !withValues {
+				node.partial = true
+				return nil
+			}
+			if strBytes, ref, err = t.readOutOfLine(first, int(strLen&^OVERFLOW_FLAG)); err != nil {
+				return err
+			}
+		} else {
+			strBytes = make([]byte, strLen)
+			if err := binary.Read(bs, binary.LittleEndian, &strBytes); err != nil {
+				return err
+			}
+		}
+
+		val, err := t.unpackValue(strBytes)
+		if err != nil {
+			return err
+		}
+		node.Values[i] = val
+
+		if ref != nil {
+			if i >= len(node.Keys) {
+				return fmt.Errorf("%w: node at %v has more values than keys", ErrorInvalidDBFormat, off)
+			}
+			if node.overflow == nil {
+				node.overflow = make(map[int64]overflowRef)
+			}
+			ref.val = val
+			node.overflow[node.Keys[i]] = *ref
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("node at offset %d: %w", off, err)
 	}
 
-	// isleaf
-	if err := binary.Read(bs, binary.LittleEndian, &node.IsLeaf); err != nil {
-		return nil, err
+	if t.strictReads {
+		if err := t.checkNode(node); err != nil {
+			return nil, err
+		}
 	}
 
-	// self
-	if err := binary.Read(bs, binary.LittleEndian, &node.Self); err != nil {
-		return nil, err
+	return node, nil
+}
+
+// checkNode makes sure a node read from disk is sane enough to be used:
+// its keys are in order and an internal node has a child for every key
+func (t *Tree) checkNode(n *Node) error {
+	if !n.IsActive {
+		return nil
 	}
 
-	// next
-	if err := binary.Read(bs, binary.LittleEndian, &node.Next); err != nil {
-		return nil, err
+	if err := n.checkKeysOrder(t.lessKey); err != nil {
+		return fmt.Errorf("%w: %v", ErrorInvalidDBFormat, err)
 	}
 
-	// prev
-	if err := binary.Read(bs, binary.LittleEndian, &node.Prev); err != nil {
-		return nil, err
+	if !n.IsLeaf && len(n.Children) != len(n.Keys) {
+		return fmt.Errorf("%w: node at %d has %d keys but %d children", ErrorInvalidDBFormat, n.Self, len(n.Keys), len(n.Children))
 	}
 
-	// parent
-	if err := binary.Read(bs, binary.LittleEndian, &node.Parent); err != nil {
-		return nil, err
+	return nil
+}
+
+func (t *Tree) Insert(key int64, val string) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	return t.insert(key, val)
+}
+
+// InsertMany inserts the pairs keys[i], vals[i] whose keys are not in the
+// tree yet and skips the others, counting both. The pairs are inserted in
+// key order; a key repeated in the batch is inserted once.
+func (t *Tree) InsertMany(keys []int64, vals []string) (inserted int, skipped int, err error) {
+	if len(keys) != len(vals) {
+		return 0, 0, fmt.Errorf("insert many: %d keys but %d values", len(keys), len(vals))
 	}
 
-	// children
-	var childCnt int64
-	if err := binary.Read(bs, binary.LittleEndian, &childCnt); err != nil {
-		return nil, err
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
 	}
-	node.Children = make([]int64, childCnt)
-	for i := int64(0); i < childCnt; i++ {
-		var child int64
-		if err := binary.Read(bs, binary.LittleEndian, &child); err != nil {
-			return nil, err
+	sort.SliceStable(order, func(i, j int) bool { return t.lessKey(keys[order[i]], keys[order[j]]) })
+
+	for _, i := range order {
+		switch err := t.insert(keys[i], vals[i]); err {
+		case nil:
+			inserted++
+		case ErrorHasExistedKey:
+			skipped++
+		default:
+			return inserted, skipped, err
 		}
-		node.Children[i] = child
 	}
 
-	// keys
-	var keysCnt int64
-	if err := binary.Read(bs, binary.LittleEndian, &keysCnt); err != nil {
-		return nil, err
+	return inserted, skipped, nil
+}
+
+func (t *Tree) insert(key int64, val string) (err error) {
+	if err := t.checkKey(key); err != nil {
+		return err
 	}
-	node.Keys = make([]int64, keysCnt)
-	for i := int64(0); i < keysCnt; i++ {
-		var key int64
-		if err := binary.Read(bs, binary.LittleEndian, &key); err != nil {
-			return nil, err
-		}
-		node.Keys[i] = key
+	if err := t.checkValue(val); err != nil {
+		return err
 	}
-
-	// values
-	var valuesCnt int64
-	if err := binary.Read(bs, binary.LittleEndian, &valuesCnt); err != nil {
-		return nil, err
+	if err := t.checkUnique(key, val); err != nil {
+		return err
 	}
-	node.Values = make([]string, valuesCnt)
-	for i := int64(0); i < valuesCnt; i++ {
-		var strLen uint32
-		if err := binary.Read(bs, binary.LittleEndian, &strLen); err != nil {
-			return nil, err
+	defer func() {
+		if err == nil {
+			t.addValueKey(key, val)
 		}
-		strBytes := make([]byte, strLen)
-		if err := binary.Read(bs, binary.LittleEndian, &strBytes); err != nil {
-			return nil, err
-		}
-		node.Values[i] = string(strBytes)
-	}
+	}()
 
-	return node, nil
-}
-
-func (t *Tree) Insert(key int64, val string) error {
 	// if tree is empty, insert it as root
 	if t.rootOff == INVALID_OFFSET {
 		node, err := t.newNodeFromDisk()
@@ -264,6 +700,36 @@ func (t *Tree) Insert(key int64, val string) error {
 	return t.insertIntoLeaf(key, val)
 }
 
+// checkKey rejects the keys refused by the KeyValidator option
+func (t *Tree) checkKey(key int64) error {
+	if t.keyValidator == nil {
+		return nil
+	}
+
+	return t.keyValidator(key)
+}
+
+// checkValue rejects the values larger than MaxValueSize or than the file
+// can store at all
+func (t *Tree) checkValue(val string) error {
+	// lengths on disk keep their top bit for OVERFLOW_FLAG
+	limit := OVERFLOW_FLAG - 1
+	if t.version < OVERFLOW_VERSION {
+		// without overflow pages, a full leaf of such values must fit in a
+		// block, leaving room for the compression tag
+		limit = t.overflowThreshold() - 1
+	}
+	if t.maxValueSize > 0 && t.maxValueSize < limit {
+		limit = t.maxValueSize
+	}
+
+	if len(val) > limit {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrorValueTooLarge, len(val), limit)
+	}
+
+	return nil
+}
+
 func (t *Tree) newNodeFromDisk() (*Node, error) {
 
 	if len(t.freeBlocks) == 0 {
@@ -287,104 +753,58 @@ func (t *Tree) newNodeFromDisk() (*Node, error) {
 func (t *Tree) flushNodeToDisk(n *Node) error {
 
 	if n == nil {
-		panic("nil node to disk")
+		return ErrorNilNode
 	}
 
 	if t.file == nil {
-		panic("file not specified, tree not initialized?")
-	}
-
-	bs := bytes.NewBuffer(make([]byte, 0))
-
-	// isactive
-	if err := binary.Write(bs, binary.LittleEndian, n.IsActive); err != nil {
-		return err
-	}
-
-	// isleaf
-	if err := binary.Write(bs, binary.LittleEndian, n.IsLeaf); err != nil {
-		return err
-	}
-
-	// self
-	if err := binary.Write(bs, binary.LittleEndian, n.Self); err != nil {
-		return err
+		return ErrorTreeNotInitialized
 	}
 
-	// next
-	if err := binary.Write(bs, binary.LittleEndian, n.Next); err != nil {
-		return err
-	}
-
-	// prev
-	if err := binary.Write(bs, binary.LittleEndian, n.Prev); err != nil {
-		return err
-	}
-
-	// parent
-	if err := binary.Write(bs, binary.LittleEndian, n.Parent); err != nil {
-		return err
-	}
-
-	// children
-	childCnt := len(n.Children)
-	if err := binary.Write(bs, binary.LittleEndian, int64(childCnt)); err != nil {
-		return err
-	}
-
-	for _, v := range n.Children {
-		if err := binary.Write(bs, binary.LittleEndian, v); err != nil {
-			return err
-		}
-	}
-
-	// keys
-	keysCnt := len(n.Keys)
-	if err := binary.Write(bs, binary.LittleEndian, int64(keysCnt)); err != nil {
-		return err
-	}
-
-	for _, v := range n.Keys {
-		if err := binary.Write(bs, binary.LittleEndian, v); err != nil {
-			return err
-		}
-	}
-
-	// values
-	valuesCnt := len(n.Values)
-	if err := binary.Write(bs, binary.LittleEndian, int64(valuesCnt)); err != nil {
-		return err
+	if n.partial {
+		return fmt.Errorf("node at %d was read without its values", n.Self)
 	}
 
-	for _, v := range n.Values {
-		if err := binary.Write(bs, binary.LittleEndian, uint32(len([]byte(v)))); err != nil {
+	if t.debugInvariants && n.IsActive {
+		if err := n.checkKeysOrder(t.lessKey); err != nil {
 			return err
 		}
-		if err := binary.Write(bs, binary.LittleEndian, []byte(v)); err != nil {
+	}
+
+	// a free block only needs to say so, and gives back its overflow pages
+	free := !n.IsActive
+	if free {
+		if err := t.replaceOverflowRefs(n, nil); err != nil {
 			return err
 		}
+		n = &Node{Self: n.Self, Next: n.Next, Prev: n.Prev, Parent: n.Parent, IsLeaf: n.IsLeaf}
 	}
 
-	//
+	refs := make(map[int64]overflowRef)
+	data, err := n.encode(blockType(n, t.version), func(bs *bytes.Buffer, i int) error {
+		var key int64
+		if i < len(n.Keys) {
+			key = n.Keys[i]
+		}
+		return t.writeValue(bs, n, key, n.Values[i], refs)
+	})
+	if err != nil {
+		return err
+	}
 
-	dataLen := len(bs.Bytes())
-	if uint32(dataLen)+8 > t.blockSize {
-		return fmt.Errorf("flushNode len(node) = %d exceed t.blockSize %d", uint64(dataLen)+4, t.blockSize)
+	if uint32(len(data))+4 > t.blockSize {
+		return fmt.Errorf("%w: flushNode len(node) = %d exceed t.blockSize %d", ErrorNodeTooLarge, len(data), t.blockSize)
 	}
 
-	tmpbs := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(tmpbs, binary.LittleEndian, uint32(dataLen)); err != nil {
-		return err
+	// the rest of the block still holds what the node held before
+	if free && t.zeroOnFree {
+		data = append(data, make([]byte, int(t.blockSize)-len(data))...)
 	}
 
-	data := append(tmpbs.Bytes(), bs.Bytes()...)
-	if length, err := t.file.WriteAt(data, int64(n.Self)); err != nil {
+	if err := t.writeBlock(data, n.Self); err != nil {
 		return err
-	} else if len(data) != length {
-		return fmt.Errorf("writeat %d into %s, expected len = %d but get %d", int64(n.Self), t.file.Name(), len(data), length)
 	}
 
-	return nil
+	return t.replaceOverflowRefs(n, refs)
 }
 
 func (t *Tree) insertIntoLeaf(key int64, val string) error {
@@ -393,11 +813,15 @@ func (t *Tree) insertIntoLeaf(key int64, val string) error {
 		return err
 	}
 
-	idx, err := leaf.insertKeyValIntoLeaf(key, val)
+	idx, err := leaf.insertKeyValIntoLeaf(t, key, val)
 	if err != nil {
 		return err
 	}
 
+	if err := t.addToCounts(leaf, 1); err != nil {
+		return err
+	}
+
 	// 这里父节点存储的是每个子节点最后一个 key
 	// 所以有可能需要更新父节点
 	if err := leaf.mayUpdateParentKeys(t, idx); err != nil {
@@ -405,7 +829,7 @@ func (t *Tree) insertIntoLeaf(key int64, val string) error {
 	}
 
 	// lead no needs to split
-	if len(leaf.Keys) <= order {
+	if len(leaf.Keys) <= t.order {
 		return t.flushNodeToDisk(leaf)
 	}
 
@@ -415,35 +839,32 @@ func (t *Tree) insertIntoLeaf(key int64, val string) error {
 		return err
 	}
 
+	// appending past the largest key, as sequential inserts do, would leave
+	// every leaf half empty with an even split, so keep the old leaf full
+	// and start the new one with just the new key
+	split := cut(t.order)
+	if leaf.Next == INVALID_OFFSET && idx == len(leaf.Keys)-1 {
+		split = t.order
+	}
+
 	newLeaf.IsLeaf = true
-	if err := t.splitLeafIntoTwoLeaves(leaf, newLeaf); err != nil {
+	if err := t.splitLeafIntoTwoLeaves(leaf, newLeaf, split); err != nil {
 		return err
 	}
 
-	return t.insertIntoParent(leaf)
+	return t.insertIntoParent(leaf, newLeaf)
 }
 
-func (t *Tree) insertIntoParent(leaf *Node) error {
-	parentOff := leaf.Parent
-	leftOff := leaf.Self
-	rightOff := leaf.Next
-	key := leaf.Keys[len(leaf.Keys)-1]
+// insertIntoParent adds right, just split off left, next to left in their
+// parent
+func (t *Tree) insertIntoParent(left, right *Node) error {
+	parentOff := left.Parent
+	rightOff := right.Self
+	key := left.Keys[len(left.Keys)-1]
 
 	// root?
 	if parentOff == INVALID_OFFSET {
-		left, err := t.seekNode(leftOff)
-		if err != nil {
-			return err
-		}
-
-		right, err := t.seekNode(rightOff)
-		if err != nil {
-			return err
-		}
-
-		if err := t.newRootNode(left, right); err != nil {
-			return err
-		}
+		return t.newRootNode(left, right)
 	}
 
 	// not root
@@ -453,7 +874,7 @@ func (t *Tree) insertIntoParent(leaf *Node) error {
 	}
 
 	// insert into parent's keys
-	idx := getIndex(parent.Keys, key)
+	idx := t.getIndex(parent.Keys, key)
 	parent.Keys = append(parent.Keys, 0)
 
 	for i := len(parent.Keys) - 1; i > idx; i-- {
@@ -463,14 +884,29 @@ func (t *Tree) insertIntoParent(leaf *Node) error {
 
 	if idx == len(parent.Children) {
 		parent.Children = append(parent.Children, rightOff)
-		return nil
+		if t.hasCounts() {
+			parent.Counts = append(parent.Counts, right.keyCount())
+		}
+		return t.flushNodeToDisk(parent)
 	}
 
-	tmpChild := parent.Children[idx+1:]
-	parent.Children = append(append(parent.Children[:idx+1], rightOff), tmpChild...)
+	// splice into a fresh slice, appending to parent.Children[:idx+1] would
+	// overwrite the children after idx before they are copied back
+	children := make([]int64, 0, len(parent.Children)+1)
+	children = append(children, parent.Children[:idx+1]...)
+	children = append(children, rightOff)
+	parent.Children = append(children, parent.Children[idx+1:]...)
+
+	// the keys of left before the split are now shared with right
+	if t.hasCounts() {
+		counts := make([]int64, 0, len(parent.Counts)+1)
+		counts = append(counts, parent.Counts[:idx]...)
+		counts = append(counts, left.keyCount(), right.keyCount())
+		parent.Counts = append(counts, parent.Counts[idx+1:]...)
+	}
 
 	// if parent no need to split
-	if len(parent.Keys) <= order {
+	if len(parent.Keys) <= t.order {
 		return t.flushNodeToDisk(parent)
 	}
 
@@ -481,11 +917,14 @@ func (t *Tree) insertIntoParent(leaf *Node) error {
 		return err
 	}
 
-	split := cut(order)
+	split := cut(t.order)
 
-	for i := split; i <= order; i++ {
+	for i := split; i <= t.order; i++ {
 		newNode.Children = append(newNode.Children, parent.Children[i])
 		newNode.Keys = append(newNode.Keys, parent.Keys[i])
+		if t.hasCounts() {
+			newNode.Counts = append(newNode.Counts, parent.Counts[i])
+		}
 
 		// update original's children's parent
 		child, err := t.seekNode(parent.Children[i])
@@ -505,6 +944,9 @@ func (t *Tree) insertIntoParent(leaf *Node) error {
 	// original parent keeps another half
 	parent.Children = parent.Children[:split]
 	parent.Keys = parent.Keys[:split]
+	if t.hasCounts() {
+		parent.Counts = parent.Counts[:split]
+	}
 
 	newNode.Next = parent.Next
 	parent.Next = newNode.Self
@@ -534,21 +976,38 @@ func (t *Tree) insertIntoParent(leaf *Node) error {
 	}
 
 	// update parent&newnode 's parent recursively
-	return t.insertIntoParent(parent)
+	return t.insertIntoParent(parent, newNode)
 }
 
-func getIndex(keys []int64, key int64) int {
+func (t *Tree) getIndex(keys []int64, key int64) int {
 	idx := sort.Search(len(keys), func(i int) bool {
-		return key <= keys[i]
+		return !t.lessKey(keys[i], key)
 	})
 
 	return idx
 }
 
+// lessKey orders keys as given to KeyOrder, ascending without it
+func (t *Tree) lessKey(a, b int64) bool {
+	if t.less == nil {
+		return a < b
+	}
+
+	return t.less(a, b)
+}
+
 // newRootNode flush new root to disk
 // flush left node
 // flush right node
 func (t *Tree) newRootNode(left, right *Node) error {
+	// the root keeps the last key of each child, a child without keys comes
+	// from a broken split or merge
+	for _, child := range []*Node{left, right} {
+		if len(child.Keys) == 0 {
+			return fmt.Errorf("%w: new root over node at %d without keys", ErrorInvalidDBFormat, child.Self)
+		}
+	}
+
 	root, err := t.newNodeFromDisk()
 	if err != nil {
 		return err
@@ -558,6 +1017,9 @@ func (t *Tree) newRootNode(left, right *Node) error {
 	root.Keys = append(root.Keys, right.Keys[len(right.Keys)-1])
 	root.Children = append(root.Children, left.Self)
 	root.Children = append(root.Children, right.Self)
+	if t.hasCounts() {
+		root.Counts = []int64{left.keyCount(), right.keyCount()}
+	}
 
 	left.Parent = root.Self
 	right.Parent = root.Self
@@ -579,11 +1041,13 @@ func cut(length int) int {
 	return (length + 1) / 2
 }
 
-func (t *Tree) splitLeafIntoTwoLeaves(leaf *Node, newLeaf *Node) error {
-	split := cut(order)
+// splitLeafIntoTwoLeaves keeps the first split keys in leaf and moves the
+// rest into newLeaf
+func (t *Tree) splitLeafIntoTwoLeaves(leaf *Node, newLeaf *Node, split int) error {
+	t.leafSplits++
 
 	// copy half to newleaf
-	for i := split; i <= order; i++ {
+	for i := split; i <= t.order; i++ {
 		newLeaf.Keys = append(newLeaf.Keys, leaf.Keys[i])
 		newLeaf.Values = append(newLeaf.Values, leaf.Values[i])
 	}
@@ -625,6 +1089,11 @@ func (t *Tree) splitLeafIntoTwoLeaves(leaf *Node, newLeaf *Node) error {
 }
 
 func (t *Tree) findLeafNode(key int64) (*Node, error) {
+	// an empty tree has no root to start from
+	if t.rootOff == INVALID_OFFSET {
+		return nil, ErrorNotFoundKey
+	}
+
 	root, err := t.seekNode(t.rootOff)
 	if err != nil {
 		return nil, err
@@ -634,7 +1103,7 @@ func (t *Tree) findLeafNode(key int64) (*Node, error) {
 	nodeIterator = root
 	for !nodeIterator.IsLeaf {
 		idx := sort.Search(len(nodeIterator.Keys), func(i int) bool {
-			return key <= nodeIterator.Keys[i]
+			return !t.lessKey(nodeIterator.Keys[i], key)
 		})
 
 		if idx == len(nodeIterator.Keys) {
@@ -642,7 +1111,7 @@ func (t *Tree) findLeafNode(key int64) (*Node, error) {
 		}
 
 		var err error
-		nodeIterator, err = t.seekNode(nodeIterator.Children[idx])
+		nodeIterator, err = t.seekNode(nodeIterator.child(idx))
 		if err != nil {
 			return nil, err
 		}
@@ -651,10 +1120,96 @@ func (t *Tree) findLeafNode(key int64) (*Node, error) {
 	return nodeIterator, nil
 }
 
-func (n *Node) insertKeyValIntoLeaf(key int64, val string) (int, error) {
-	idx := sort.Search(len(n.Keys), func(i int) bool {
-		return key <= n.Keys[i]
-	})
+// firstLeafNode returns the leftmost leaf, the head of the leaf chain
+func (t *Tree) firstLeafNode() (*Node, error) {
+	// an empty tree has no root to start from
+	if t.rootOff == INVALID_OFFSET {
+		return nil, ErrorNotFoundKey
+	}
+
+	node, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return nil, err
+	}
+
+	for !node.IsLeaf {
+		if node, err = t.seekNode(node.child(0)); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// lastLeafNode returns the rightmost leaf, the tail of the leaf chain
+func (t *Tree) lastLeafNode() (*Node, error) {
+	if t.rootOff == INVALID_OFFSET {
+		return nil, ErrorNotFoundKey
+	}
+
+	node, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return nil, err
+	}
+
+	for !node.IsLeaf {
+		if node, err = t.seekNode(node.child(len(node.Children) - 1)); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// readBlockType reads the type byte of the block at off alone, BLOCK_FREE
+// for a block never written
+func (t *Tree) readBlockType(off int64) (uint8, error) {
+	buf := make([]byte, 5)
+	n, err := t.readAt(buf, off)
+	if n == 0 && err == io.EOF {
+		return 0, fmt.Errorf("%w: %v is past the end of %v", ErrorOffsetOutOfRange, off, t.file.Name())
+	}
+	if n < len(buf) {
+		return 0, fmt.Errorf("%w: read at %v from %v, expect len = %v but got %v: %v", ErrorShortRead, off, t.file.Name(), len(buf), n, err)
+	}
+
+	if binary.LittleEndian.Uint32(buf) == 0 {
+		return BLOCK_FREE, nil
+	}
+
+	return buf[4], nil
+}
+
+func encodeBool(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func decodeBool(b uint8) (bool, error) {
+	switch b {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: boolean byte %d", ErrorInvalidDBFormat, b)
+}
+
+// checkKeysOrder makes sure the keys are strictly increasing by less
+func (n *Node) checkKeysOrder(less func(a, b int64) bool) error {
+	for i := 1; i < len(n.Keys); i++ {
+		if !less(n.Keys[i-1], n.Keys[i]) {
+			return fmt.Errorf("node at %d has keys out of order: %v", n.Self, n.Keys)
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) insertKeyValIntoLeaf(t *Tree, key int64, val string) (int, error) {
+	idx := t.getIndex(n.Keys, key)
 
 	if idx < len(n.Keys) && n.Keys[idx] == key {
 		return 0, ErrorHasExistedKey
@@ -675,6 +1230,61 @@ func (n *Node) insertKeyValIntoLeaf(key int64, val string) (int, error) {
 	return idx, nil
 }
 
+// hasCounts tells if the internal nodes keep the key counts of their
+// children, files older than SUBTREE_COUNT_VERSION do not
+func (t *Tree) hasCounts() bool {
+	return t.version >= SUBTREE_COUNT_VERSION
+}
+
+// keyCount returns how many keys are under n
+func (n *Node) keyCount() int64 {
+	if n.IsLeaf {
+		return int64(len(n.Keys))
+	}
+
+	cnt := int64(0)
+	for _, c := range n.Counts {
+		cnt += c
+	}
+
+	return cnt
+}
+
+// addToCounts adds delta to the key count every ancestor of n keeps for
+// the subtree n is in
+func (t *Tree) addToCounts(n *Node, delta int64) error {
+	if !t.hasCounts() {
+		return nil
+	}
+
+	for n.Parent != INVALID_OFFSET {
+		parent, err := t.seekNode(n.Parent)
+		if err != nil {
+			return err
+		}
+
+		idx := -1
+		for k, v := range parent.Children {
+			if v == n.Self {
+				idx = k
+				break
+			}
+		}
+		if idx == -1 {
+			return fmt.Errorf("%w: node at %v is not a child of its parent %v", ErrorInvalidDBFormat, n.Self, parent.Self)
+		}
+
+		parent.addCount(idx, delta)
+		if err := t.flushNodeToDisk(parent); err != nil {
+			return err
+		}
+
+		n = parent
+	}
+
+	return nil
+}
+
 // 父节点存储字节点最后一个 key
 func (leaf *Node) mayUpdateParentKeys(t *Tree, idx int) error {
 	if idx == len(leaf.Keys)-1 && leaf.Parent != INVALID_OFFSET {
@@ -698,7 +1308,7 @@ func (leaf *Node) mayUpdateParentKeys(t *Tree, idx int) error {
 				}
 			}
 
-			nodeParentIterator.Keys[idx] = key
+			nodeParentIterator.setKey(idx, key)
 
 			t.flushNodeToDisk(nodeParentIterator)
 
@@ -710,15 +1320,191 @@ func (leaf *Node) mayUpdateParentKeys(t *Tree, idx int) error {
 	return nil
 }
 
-// Find the key
-func (t *Tree) Find(key int64) (string, error) {
+// Delete the key
+func (t *Tree) Delete(key int64) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	return t.deleteKey(key)
+}
+
+func (t *Tree) deleteKey(key int64) error {
+	if err := t.checkKey(key); err != nil {
+		return err
+	}
+
+	if t.rootOff == INVALID_OFFSET {
+		return ErrorNotFoundKey
+	}
+
+	leaf, err := t.findLeafNode(key)
+	if err != nil {
+		return err
+	}
+
+	idx := t.getIndex(leaf.Keys, key)
+	if idx == len(leaf.Keys) || leaf.Keys[idx] != key {
+		return ErrorNotFoundKey
+	}
+
+	t.removeValueKey(leaf.Values[idx])
+	leaf.Keys = append(leaf.Keys[:idx], leaf.Keys[idx+1:]...)
+	leaf.Values = append(leaf.Values[:idx], leaf.Values[idx+1:]...)
+
+	if err := t.addToCounts(leaf, -1); err != nil {
+		return err
+	}
+
+	// empty leaf is removed from the tree entirely
+	if len(leaf.Keys) == 0 {
+		if err := t.removeNode(leaf); err != nil {
+			return err
+		}
+		return t.mayShrinkRoot()
+	}
+
+	// the last key is gone, parents need the new last one
+	if idx == len(leaf.Keys) {
+		if err := leaf.mayUpdateParentKeys(t, idx-1); err != nil {
+			return err
+		}
+	}
+
+	return t.flushNodeToDisk(leaf)
+}
+
+// removeNode unlinks an empty node from its siblings and its parent,
+// then frees its block. The parent is removed as well if it becomes empty.
+func (t *Tree) removeNode(n *Node) error {
+	if n.Prev != INVALID_OFFSET {
+		prev, err := t.seekNode(n.Prev)
+		if err != nil {
+			return err
+		}
+		prev.Next = n.Next
+		if err := t.flushNodeToDisk(prev); err != nil {
+			return err
+		}
+	}
+
+	if n.Next != INVALID_OFFSET {
+		next, err := t.seekNode(n.Next)
+		if err != nil {
+			return err
+		}
+		next.Prev = n.Prev
+		if err := t.flushNodeToDisk(next); err != nil {
+			return err
+		}
+	}
+
+	if err := t.freeNode(n); err != nil {
+		return err
+	}
+
+	// root?
+	if n.Parent == INVALID_OFFSET {
+		t.rootOff = INVALID_OFFSET
+		return nil
+	}
+
+	parent, err := t.seekNode(n.Parent)
+	if err != nil {
+		return err
+	}
+
+	idx := 0
+	for k, v := range parent.Children {
+		if v == n.Self {
+			idx = k
+			break
+		}
+	}
+
+	parent.Keys = append(parent.Keys[:idx], parent.Keys[idx+1:]...)
+	parent.Children = append(parent.Children[:idx], parent.Children[idx+1:]...)
+	if t.hasCounts() {
+		parent.Counts = append(parent.Counts[:idx], parent.Counts[idx+1:]...)
+	}
+
+	if len(parent.Keys) == 0 {
+		return t.removeNode(parent)
+	}
+
+	// the last child is gone, grandparents need the new last key
+	if idx == len(parent.Keys) {
+		if err := parent.mayUpdateParentKeys(t, idx-1); err != nil {
+			return err
+		}
+	}
+
+	return t.flushNodeToDisk(parent)
+}
+
+// mayShrinkRoot makes the only child of the root the new root
+func (t *Tree) mayShrinkRoot() error {
+	for t.rootOff != INVALID_OFFSET {
+		root, err := t.seekNode(t.rootOff)
+		if err != nil {
+			return err
+		}
+
+		if root.IsLeaf || len(root.Children) != 1 {
+			return nil
+		}
+
+		child, err := t.seekNode(root.Children[0])
+		if err != nil {
+			return err
+		}
+
+		child.Parent = INVALID_OFFSET
+		if err := t.flushNodeToDisk(child); err != nil {
+			return err
+		}
+
+		if err := t.freeNode(root); err != nil {
+			return err
+		}
+
+		t.rootOff = child.Self
+	}
+
+	return nil
+}
+
+// freeNode marks the node inactive on disk and recycles its block
+func (t *Tree) freeNode(n *Node) error {
+	n.IsActive = false
+	if err := t.flushNodeToDisk(n); err != nil {
+		return err
+	}
+
+	t.freeBlocks = append(t.freeBlocks, n.Self)
+
+	return nil
+}
+
+// Find the key, ErrorNotFoundKey is only returned if the key is absent
+// from a readable leaf
+func (t *Tree) Find(key int64) (_ string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	return t.find(key)
+}
+
+func (t *Tree) find(key int64) (string, error) {
 	if t.rootOff == INVALID_OFFSET {
 		return "", ErrorNotFoundKey
 	}
 
+	// a broken path must not look like a missing key
 	node, err := t.findLeafNode(key)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("find key %d: %w", key, err)
 	}
 
 	for i, nkey := range node.Keys {
@@ -730,6 +1516,92 @@ func (t *Tree) Find(key int64) (string, error) {
 	return "", ErrorNotFoundKey
 }
 
+// Modify reads the current value of the key and replaces it with the one
+// returned by fn, all under the write lock. If fn returns keep == false,
+// the key is deleted instead.
+func (t *Tree) Modify(key int64, fn func(old string, exists bool) (string, bool)) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	old, err := t.find(key)
+	if err != nil && err != ErrorNotFoundKey {
+		return err
+	}
+	exists := err == nil
+
+	val, keep := fn(old, exists)
+	switch {
+	case keep && exists:
+		return t.update(key, val)
+	case keep:
+		return t.insert(key, val)
+	case exists:
+		return t.deleteKey(key)
+	}
+
+	return nil
+}
+
+// Put inserts the key or overwrites its value, returning the value it
+// replaced if there was one
+func (t *Tree) Put(key int64, val string) (prev string, existed bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	prev, err = t.find(key)
+	switch err {
+	case nil:
+		return prev, true, t.update(key, val)
+	case ErrorNotFoundKey:
+		return "", false, t.insert(key, val)
+	}
+
+	return "", false, err
+}
+
+// Update the value of an existing key
+func (t *Tree) Update(key int64, val string) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	return t.update(key, val)
+}
+
+func (t *Tree) update(key int64, val string) error {
+	if err := t.checkKey(key); err != nil {
+		return err
+	}
+	if err := t.checkValue(val); err != nil {
+		return err
+	}
+	if err := t.checkUnique(key, val); err != nil {
+		return err
+	}
+
+	if t.rootOff == INVALID_OFFSET {
+		return ErrorNotFoundKey
+	}
+
+	leaf, err := t.findLeafNode(key)
+	if err != nil {
+		return err
+	}
+
+	idx := t.getIndex(leaf.Keys, key)
+	if idx == len(leaf.Keys) || leaf.Keys[idx] != key {
+		return ErrorNotFoundKey
+	}
+
+	t.removeValueKey(leaf.Values[idx])
+	t.addValueKey(key, val)
+	leaf.Values[idx] = val
+
+	return t.flushNodeToDisk(leaf)
+}
+
 // PrintTree print the whole tree
 func (t *Tree) PrintTree() error {
 	if t.rootOff == INVALID_OFFSET {
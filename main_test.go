@@ -1,7 +1,17 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestInsert(t *testing.T) {
@@ -18,3 +28,1006 @@ func TestInsert(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSequentialInsertFillsLeaves(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "append.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const keys = 1000
+	for i := int64(1); i <= keys; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if max := int64(keys / tree.order); tree.leafSplits > max {
+		t.Fatalf("expected at most %d leaf splits, got %d", max, tree.leafSplits)
+	}
+
+	height, err := tree.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves, err := tree.LevelKeys(height - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, leaf := range leaves[:len(leaves)-1] {
+		if len(leaf) != tree.order {
+			t.Fatalf("leaf %d holds %d keys, expected %d", i, len(leaf), tree.order)
+		}
+	}
+}
+
+func TestInsertMany(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "many.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 10; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("old%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 5..30 out of order, 12 twice
+	var keys []int64
+	var vals []string
+	for i := int64(30); i >= 5; i-- {
+		keys = append(keys, i)
+		vals = append(vals, fmt.Sprintf("new%d", i))
+	}
+	keys = append(keys, 12)
+	vals = append(vals, "again12")
+
+	inserted, skipped, err := tree.InsertMany(keys, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 20 || skipped != 7 {
+		t.Fatalf("expected 20 inserted and 7 skipped, got %d and %d", inserted, skipped)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 30; i++ {
+		want := fmt.Sprintf("new%d", i)
+		if i <= 10 {
+			want = fmt.Sprintf("old%d", i)
+		}
+		if val, err := tree.Find(i); err != nil || val != want {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+
+	if _, _, err := tree.InsertMany([]int64{1}, nil); err == nil {
+		t.Fatal("expected an error for mismatched lengths")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "delete.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := int64(2); i <= 100; i += 2 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tree.Delete(2); err != ErrorNotFoundKey {
+		t.Fatalf("expected %v, got %v", ErrorNotFoundKey, err)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		val, err := tree.Find(i)
+		if i%2 == 0 {
+			if err != ErrorNotFoundKey {
+				t.Fatalf("key %d: expected %v, got %v", i, ErrorNotFoundKey, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q", i, val)
+		}
+	}
+}
+
+func TestInsertAfterDeleteAll(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reuse.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 20; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := int64(1); i <= 20; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tree.rootOff != INVALID_OFFSET {
+		t.Fatalf("expected empty tree, root at %d", tree.rootOff)
+	}
+
+	if err := tree.Insert(42, "test42"); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := tree.Find(42); err != nil || val != "test42" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	// the recycled block must be the only active one after reopening
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if val, err := tree.Find(42); err != nil || val != "test42" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	if _, err := tree.Find(1); err != ErrorNotFoundKey {
+		t.Fatalf("expected %v, got %v", ErrorNotFoundKey, err)
+	}
+}
+
+func TestModify(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "modify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// insert
+	err = tree.Modify(1, func(old string, exists bool) (string, bool) {
+		if exists {
+			t.Fatalf("key 1 should not exist, got %q", old)
+		}
+		return "test1", true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	// update
+	err = tree.Modify(1, func(old string, exists bool) (string, bool) {
+		if !exists || old != "test1" {
+			t.Fatalf("got %q, %v", old, exists)
+		}
+		return old + "-updated", true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1-updated" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	// delete
+	err = tree.Modify(1, func(old string, exists bool) (string, bool) {
+		return "", false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Find(1); err != ErrorNotFoundKey {
+		t.Fatalf("expected %v, got %v", ErrorNotFoundKey, err)
+	}
+
+	// deleting a missing key is a no-op
+	err = tree.Modify(2, func(old string, exists bool) (string, bool) {
+		return "", false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPut(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "put.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	prev, existed, err := tree.Put(1, "first")
+	if err != nil || existed || prev != "" {
+		t.Fatalf("first put: got %q, %v, %v", prev, existed, err)
+	}
+
+	prev, existed, err = tree.Put(1, "second")
+	if err != nil || !existed || prev != "first" {
+		t.Fatalf("overwrite: got %q, %v, %v", prev, existed, err)
+	}
+
+	if val, err := tree.Find(1); err != nil || val != "second" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reopen.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 10; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(11); i <= 50; i++ {
+		if err := other.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tree.Find(1); err != ErrorNotFoundKey {
+		t.Fatalf("expected %v, got %v", ErrorNotFoundKey, err)
+	}
+	for i := int64(2); i <= 50; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenKeepsFileSize(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "open.db")
+	tree, err := NewTree(filename, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 20; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening and reading reserves no block
+	for n := 0; n < 3; n++ {
+		tree, err := NewTree(filename, MinPrealloc(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val, err := tree.Find(7); err != nil || val != "test7" {
+			t.Fatalf("got %q, %v", val, err)
+		}
+		if tree.fileSize != before.Size() {
+			t.Fatalf("fileSize went from %d to %d", before.Size(), tree.fileSize)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("file went from %d to %d bytes", before.Size(), after.Size())
+	}
+}
+
+func TestTrimTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "trim.db")
+	tree, err := NewTree(filename, MinPrealloc(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 20; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// empty the first leaf, leaving a hole that is not at the end
+	for i := int64(1); i <= 4; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.TrimTail(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() || after.Size()%int64(tree.blockSize) != 0 {
+		t.Fatalf("file went from %d to %d bytes", before.Size(), after.Size())
+	}
+	for _, off := range tree.freeBlocks {
+		if off >= after.Size() {
+			t.Fatalf("free block %d past the end of the file at %d", off, after.Size())
+		}
+	}
+	if len(tree.freeBlocks) == 0 {
+		t.Fatal("expected the hole to stay in the free list")
+	}
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(5); i <= 20; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+
+	// the file grows again when needed
+	for i := int64(21); i <= 60; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefragFreeList(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "defrag.db"), MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 40; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// empty whole leaves in no particular order
+	for _, first := range []int64{33, 9, 21, 1, 13} {
+		for i := first; i < first+4; i++ {
+			if err := tree.Delete(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if sort.SliceIsSorted(tree.freeBlocks, func(i, j int) bool { return tree.freeBlocks[i] < tree.freeBlocks[j] }) {
+		t.Fatalf("expected scattered free blocks, got %v", tree.freeBlocks)
+	}
+
+	if err := tree.DefragFreeList(); err != nil {
+		t.Fatal(err)
+	}
+
+	last := int64(-1)
+	for len(tree.freeBlocks) > 0 {
+		node, err := tree.newNodeFromDisk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Self <= last {
+			t.Fatalf("allocated %d after %d", node.Self, last)
+		}
+		last = node.Self
+	}
+}
+
+func TestFlushNodeToDiskErrors(t *testing.T) {
+	var tree Tree
+
+	if err := tree.flushNodeToDisk(nil); err != ErrorNilNode {
+		t.Fatalf("expected %v, got %v", ErrorNilNode, err)
+	}
+
+	if err := tree.flushNodeToDisk(&Node{}); err != ErrorTreeNotInitialized {
+		t.Fatalf("expected %v, got %v", ErrorTreeNotInitialized, err)
+	}
+}
+
+func TestFindReadsOnlyPath(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "path.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	height, err := tree.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []int64{1, 4, 5, 100, 199, 200, 201} {
+		before := atomic.LoadInt64(&tree.reads)
+		tree.Find(key)
+		if reads := atomic.LoadInt64(&tree.reads) - before; reads > int64(height+1) {
+			t.Fatalf("key %d: %d reads for a tree of height %d", key, reads, height)
+		}
+	}
+}
+
+func TestFindReadError(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "find.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leaf, err := tree.findLeafNode(25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an impossible data length makes the leaf unreadable
+	if _, err := tree.file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, leaf.Self); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []int64{25, leaf.Keys[0], leaf.Keys[len(leaf.Keys)-1]} {
+		_, err := tree.Find(key)
+		if err == nil || errors.Is(err, ErrorNotFoundKey) {
+			t.Fatalf("key %d: expected a read error, got %v", key, err)
+		}
+		if !errors.Is(err, ErrorNodeTooLarge) {
+			t.Fatalf("key %d: expected %v, got %v", key, ErrorNodeTooLarge, err)
+		}
+	}
+
+	// other leaves still tell a missing key apart
+	if _, err := tree.Find(1000); err != ErrorNotFoundKey {
+		t.Fatalf("expected %v, got %v", ErrorNotFoundKey, err)
+	}
+}
+
+func TestShortRead(t *testing.T) {
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "short.db"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// the node claims 100 bytes but the file ends after 4 of them
+	if _, err := file.Write([]byte{100, 0, 0, 0, 1, 1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &Tree{file: fileStore{file}, blockSize: BLOCK_SIZE}
+	if _, err := tree.seekNode(0); !errors.Is(err, ErrorShortRead) {
+		t.Fatalf("expected %v, got %v", ErrorShortRead, err)
+	}
+
+	// nothing at all past the end of the file
+	if _, err := tree.seekNode(BLOCK_SIZE); !errors.Is(err, ErrorOffsetOutOfRange) {
+		t.Fatalf("expected %v, got %v", ErrorOffsetOutOfRange, err)
+	}
+}
+
+func TestNewTreeFromFile(t *testing.T) {
+	file, err := ioutil.TempFile(t.TempDir(), "fromfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := NewTreeFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree owns the file
+	if err := file.Close(); err == nil {
+		t.Fatal("expected the file to be closed by the tree")
+	}
+
+	tree, err = NewTree(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func BenchmarkAppendInsert(b *testing.B) {
+	var splits int64
+	for n := 0; n < b.N; n++ {
+		tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for i := int64(1); i <= 100000; i++ {
+			if err := tree.Insert(i, "value"); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		splits += tree.leafSplits
+		tree.Close()
+	}
+
+	b.ReportMetric(float64(splits)/float64(b.N), "leafsplits/op")
+}
+
+// workloadKey returns the i-th key of the workload seed. Every step is a
+// bijection of uint64, so distinct i give distinct keys without keeping
+// track of the ones handed out, and the keys are spread all over int64.
+func workloadKey(i int, seed int64) int64 {
+	x := uint64(i) + uint64(seed)*0x9e3779b97f4a7c15
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 31
+	x *= 0x94d049bb133111eb
+	x ^= x >> 29
+
+	return int64(x)
+}
+
+// insertBenchmarkWorkload inserts n unique pseudo-random keys, the same
+// ones in the same order for a given seed
+func (t *Tree) insertBenchmarkWorkload(n int, seed int64) error {
+	for i := 0; i < n; i++ {
+		key := workloadKey(i, seed)
+		if err := t.Insert(key, fmt.Sprintf("value%d", i)); err != nil {
+			return fmt.Errorf("workload key %d (%d): %w", i, key, err)
+		}
+	}
+
+	return nil
+}
+
+func TestBenchmarkWorkload(t *testing.T) {
+	var first []int64
+	for run := 0; run < 2; run++ {
+		tree, err := NewTree(filepath.Join(t.TempDir(), "workload.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tree.insertBenchmarkWorkload(2000, 42); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := tree.AllKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Close()
+
+		if len(keys) != 2000 {
+			t.Fatalf("expected 2000 keys, got %d", len(keys))
+		}
+		if run == 1 && !reflect.DeepEqual(keys, first) {
+			t.Fatal("the same seed gave different keys")
+		}
+		first = keys
+	}
+
+	if workloadKey(0, 1) == workloadKey(0, 2) {
+		t.Fatal("expected different seeds to give different keys")
+	}
+}
+
+func BenchmarkRandomInsert(b *testing.B) {
+	const keys = 20000
+
+	var splits int64
+	var elapsed time.Duration
+	for n := 0; n < b.N; n++ {
+		tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		start := time.Now()
+		if err := tree.insertBenchmarkWorkload(keys, int64(n)); err != nil {
+			b.Fatal(err)
+		}
+		elapsed += time.Since(start)
+
+		splits += tree.leafSplits
+		tree.Close()
+	}
+
+	b.ReportMetric(float64(keys*b.N)/elapsed.Seconds(), "inserts/s")
+	b.ReportMetric(float64(splits)/float64(keys*b.N), "leafsplits/insert")
+}
+
+func TestInsertIntoParentMiddle(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "middle.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// the odd keys split leaves in the middle of their parents
+	for i := int64(2); i <= 400; i += 2 {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 400; i += 2 {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("after inserting %d: %v", i, err)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(400) {
+		key := int64(1000 + i)
+		if err := tree.Insert(key, fmt.Sprintf("test%d", key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 800 {
+		t.Fatalf("expected 800 keys, got %d", len(keys))
+	}
+	for _, key := range keys {
+		if val, err := tree.Find(key); err != nil || val != fmt.Sprintf("test%d", key) {
+			t.Fatalf("key %d: got %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestNewRootNodeEmptyChild(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "emptyroot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	right, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, err := tree.newNodeFromDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	left.IsLeaf = true
+
+	rootOff, free := tree.rootOff, len(tree.freeBlocks)
+	if err := tree.newRootNode(left, right); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+	if err := tree.newRootNode(right, left); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+
+	// nothing was allocated or changed
+	if tree.rootOff != rootOff || len(tree.freeBlocks) != free {
+		t.Fatalf("root moved to %d and %d free blocks left, expected %d and %d", tree.rootOff, len(tree.freeBlocks), rootOff, free)
+	}
+}
+
+func TestAllocPastFreeBlocks(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "alloc.db"), MinPrealloc(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a free list kept from before the file was cut short
+	bs := int64(tree.blockSize)
+	high := tree.fileSize + 5*bs
+	tree.freeBlocks = []int64{high, high - 2*bs}
+
+	if err := tree.allocNewFreeNodeInDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int64]bool)
+	for _, off := range tree.freeBlocks {
+		if seen[off] {
+			t.Fatalf("block %d handed out twice in %v", off, tree.freeBlocks)
+		}
+		seen[off] = true
+		if off >= tree.fileSize {
+			t.Fatalf("free block %d past the end of the file at %d", off, tree.fileSize)
+		}
+	}
+	if len(tree.freeBlocks) != 8 {
+		t.Fatalf("expected 8 free blocks, got %v", tree.freeBlocks)
+	}
+
+	for i := int64(2); i <= 50; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenExisting(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "existing.db")
+	if _, err := OpenExisting(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %v, got %v", os.ErrNotExist, err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("expected no file to be created, got %v", err)
+	}
+
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenExisting(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func TestFailedOpenClosesFiles(t *testing.T) {
+	fds := func() int {
+		entries, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("no /proc/self/fd")
+		}
+		return len(entries)
+	}
+
+	dir := t.TempDir()
+	newFile := func(name string, opts ...Option) string {
+		filename := filepath.Join(dir, name)
+		tree, err := NewTree(filename, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(1); i <= 3; i++ {
+			if err := tree.Insert(i, "same"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	// a file newer than the code
+	newer := newFile("newer.db")
+	f, err := os.OpenFile(newer, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{DB_VERSION + 1}, 4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// a file ending in a partial block
+	misaligned := newFile("misaligned.db")
+	f, err = os.OpenFile(misaligned, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cases := []struct {
+		filename string
+		opts     []Option
+	}{
+		{newer, nil},
+		{misaligned, nil},
+		{newFile("cmp.db", KeyOrder("desc", func(a, b int64) bool { return a > b })), nil},
+		// fails once the side file is open
+		{newFile("unique.db", SeparateValues()), []Option{UniqueValues()}},
+	}
+
+	before := fds()
+	for _, c := range cases {
+		if _, err := NewTree(c.filename, c.opts...); err == nil {
+			t.Fatalf("%s: expected NewTree to fail", c.filename)
+		}
+		if _, err := OpenExisting(c.filename, c.opts...); err == nil {
+			t.Fatalf("%s: expected OpenExisting to fail", c.filename)
+		}
+		if n := fds(); n != before {
+			t.Fatalf("%s: %d files open after the failed opens, %d before", c.filename, n, before)
+		}
+	}
+}
+
+func TestNewTreeCmp(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cmp.db")
+	desc := func(a, b int64) bool { return a > b }
+
+	tree, err := NewTreeCmp(filename, "desc", desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(100) {
+		if err := tree.Insert(int64(i), fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if key, val, ok, err := tree.Min(); err != nil || !ok || key != 99 || val != "test99" {
+		t.Fatalf("Min: got %d, %q, %v, %v", key, val, ok, err)
+	}
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if key != int64(99-i) {
+			t.Fatalf("expected %d at %d, got %d", 99-i, i, key)
+		}
+	}
+	for i := int64(0); i < 100; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewTree(filename); !errors.Is(err, ErrorKeyOrderMismatch) {
+		t.Fatalf("expected %v, got %v", ErrorKeyOrderMismatch, err)
+	}
+	// another comparator goes under another name
+	asc := func(a, b int64) bool { return a < b }
+	if _, err := NewTreeCmp(filename, "asc", asc); !errors.Is(err, ErrorKeyOrderMismatch) {
+		t.Fatalf("expected %v, got %v", ErrorKeyOrderMismatch, err)
+	}
+	if _, err := NewTreeCmp(filepath.Join(t.TempDir(), "noname.db"), "", asc); !errors.Is(err, ErrorKeyOrderMismatch) {
+		t.Fatalf("expected %v for an empty name, got %v", ErrorKeyOrderMismatch, err)
+	}
+
+	tree, err = NewTreeCmp(filename, "desc", desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if key, _, ok, err := tree.Min(); err != nil || !ok || key != 99 {
+		t.Fatalf("Min after reopen: got %d, %v, %v", key, ok, err)
+	}
+
+	// files older than KEY_ORDER_NAME_VERSION have no name to check
+	if err := tree.writeAt([]byte{KEY_ORDER_NAME_VERSION - 1}, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTreeCmp(filename, "other", desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MERGE_BATCH is how many pairs MergeInto reads from the source at a time
+const MERGE_BATCH = 256
+
+// MergeInto copies every pair of src into dst in key order. A key present
+// in both gets the value onConflict returns for it, or the src value if
+// onConflict is nil. src is read MERGE_BATCH pairs at a time under its read
+// lock, and each batch is written under the write lock of dst, so the two
+// trees are never locked together but writes to src during the merge may
+// or may not be seen.
+func MergeInto(dst *Tree, src *Tree, onConflict func(key int64, dstVal, srcVal string) string) error {
+	if dst == src {
+		return errors.New("merge into: source and destination are the same tree")
+	}
+
+	var after int64
+	for first := true; ; first = false {
+		keys, vals, err := src.batchAfter(after, first, MERGE_BATCH)
+		if err != nil {
+			return fmt.Errorf("merge into: read source: %w", err)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if err := dst.mergeBatch(keys, vals, onConflict); err != nil {
+			return fmt.Errorf("merge into: %w", err)
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// batchAfter returns up to limit pairs following after in key order, or
+// the first ones if first is set
+func (t *Tree) batchAfter(after int64, first bool, limit int) (_ []int64, _ []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	keys := make([]int64, 0, limit)
+	vals := make([]string, 0, limit)
+	collect := func(key int64, val string) bool {
+		if !first && key == after {
+			return true
+		}
+		keys = append(keys, key)
+		vals = append(vals, val)
+		return len(keys) < limit
+	}
+
+	if first {
+		err = t.ascendAll(collect)
+	} else {
+		err = t.ascend(after, collect)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, vals, nil
+}
+
+// mergeBatch inserts the pairs, resolving the keys already there with
+// onConflict
+func (t *Tree) mergeBatch(keys []int64, vals []string, onConflict func(key int64, dstVal, srcVal string) string) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	for i, key := range keys {
+		old, err := t.find(key)
+		if err == ErrorNotFoundKey {
+			if err := t.insert(key, vals[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		val := vals[i]
+		if onConflict != nil {
+			val = onConflict(key, old, vals[i])
+		}
+		if val == old {
+			continue
+		}
+		if err := t.update(key, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeInto(t *testing.T) {
+	dir := t.TempDir()
+	newTree := func(name string, from, to, step int64, prefix string) *Tree {
+		tree, err := NewTree(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := from; i <= to; i += step {
+			if err := tree.Insert(i, fmt.Sprintf("%s%d", prefix, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tree
+	}
+
+	// disjoint, src spans several batches
+	dst := newTree("dst.db", 1, 999, 2, "dst")
+	defer dst.Close()
+	src := newTree("src.db", 2, 1000, 2, "src")
+	defer src.Close()
+
+	if err := MergeInto(dst, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 1000; i++ {
+		want := fmt.Sprintf("dst%d", i)
+		if i%2 == 0 {
+			want = fmt.Sprintf("src%d", i)
+		}
+		if val, err := dst.Find(i); err != nil || val != want {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+
+	// overlapping, the conflicts are resolved by onConflict
+	over := newTree("over.db", 991, 1010, 1, "over")
+	defer over.Close()
+
+	conflicts := 0
+	err := MergeInto(dst, over, func(key int64, dstVal, srcVal string) string {
+		conflicts++
+		return dstVal + "+" + srcVal
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflicts != 10 {
+		t.Fatalf("expected 10 conflicts, got %d", conflicts)
+	}
+	if val, err := dst.Find(995); err != nil || val != "dst995+over995" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+	if val, err := dst.Find(1005); err != nil || val != "over1005" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	// src is left as it is
+	if val, err := src.Find(2); err != nil || val != "src2" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	if err := MergeInto(dst, dst, nil); err == nil {
+		t.Fatal("expected merging a tree into itself to fail")
+	}
+}
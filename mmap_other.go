@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+// remap does nothing here, reads always go through ReadAt
+func (t *Tree) remap() error {
+	return nil
+}
+
+func (t *Tree) unmap() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestUseMmap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mmap.db")
+	tree, err := NewTree(filename, UseMmap(), MinPrealloc(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// small prealloc, so the file grows and is remapped many times
+	for i := int64(1); i <= 300; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Update(42, "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename, UseMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 300; i++ {
+		want := fmt.Sprintf("test%d", i)
+		if i == 42 {
+			want = "updated"
+		}
+		if val, err := tree.Find(i); err != nil || val != want {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+}
+
+func benchmarkFind(b *testing.B, opts ...Option) {
+	tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"), opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tree.Close()
+
+	const keys = 10000
+	for i := int64(1); i <= keys; i++ {
+		if err := tree.Insert(i, "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := tree.Find(int64(n%keys) + 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	benchmarkFind(b)
+}
+
+func BenchmarkFindMmap(b *testing.B) {
+	benchmarkFind(b, UseMmap())
+}
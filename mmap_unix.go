@@ -0,0 +1,39 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import "syscall"
+
+// remap maps the first t.fileSize bytes of the file if UseMmap is set,
+// replacing any previous mapping. Writes go through WriteAt, which the
+// shared mapping sees through the page cache without an msync.
+func (t *Tree) remap() error {
+	if err := t.unmap(); err != nil {
+		return err
+	}
+
+	f, ok := t.file.(fileStore)
+	if !t.useMmap || !ok || t.fileSize == 0 {
+		return nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(t.fileSize), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	t.mapped = data
+
+	return nil
+}
+
+func (t *Tree) unmap() error {
+	if t.mapped == nil {
+		return nil
+	}
+
+	data := t.mapped
+	t.mapped = nil
+
+	return syscall.Munmap(data)
+}
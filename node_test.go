@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenNode is encoded in testdata/node.golden, the file must only change
+// along with the on-disk format version
+func goldenNode() *Node {
+	return &Node{
+		IsActive: true,
+		IsLeaf:   true,
+		Self:     4096,
+		Next:     8192,
+		Prev:     INVALID_OFFSET,
+		Parent:   12288,
+		Children: []int64{},
+		Keys:     []int64{1, -2, 300},
+		Values:   []string{"xiao", "long", "bao"},
+	}
+}
+
+func TestNodeLayoutGolden(t *testing.T) {
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "golden.db"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tree := &Tree{file: fileStore{file}, blockSize: BLOCK_SIZE}
+	node := goldenNode()
+	if err := tree.flushNodeToDisk(node); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = got[node.Self:]
+
+	golden := filepath.Join("testdata", "node.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("node layout changed:\ngot  %x\nwant %x", got, want)
+	}
+
+	decoded, err := tree.seekNode(node.Self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, node) {
+		t.Fatalf("decoded %+v, expected %+v", decoded, node)
+	}
+}
+
+func TestNodeInvalidBool(t *testing.T) {
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "bool.db"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tree := &Tree{file: fileStore{file}, blockSize: BLOCK_SIZE}
+	node := goldenNode()
+	node.Self = 0
+	if err := tree.flushNodeToDisk(node); err != nil {
+		t.Fatal(err)
+	}
+
+	// isleaf follows datalen and isactive, a 2 in isactive would mark an
+	// overflow page
+	if _, err := file.WriteAt([]byte{2}, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tree.seekNode(0); err == nil {
+		t.Fatal("expected an error for a boolean byte of 2")
+	}
+}
+
+func TestNodeBlockType(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "type.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 8; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leaves, internals, free := 0, 0, 0
+	err = tree.eachBlock(func(off int64, n *Node) error {
+		kind, err := tree.readBlockType(off)
+		if err != nil {
+			return err
+		}
+
+		want := uint8(BLOCK_FREE)
+		switch {
+		case n.IsActive && n.IsLeaf:
+			want = BLOCK_LEAF
+			leaves++
+		case n.IsActive:
+			want = BLOCK_COUNTED
+			internals++
+		default:
+			free++
+		}
+		if kind != want {
+			t.Fatalf("block at %d has type %d, expected %d", off, kind, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaves == 0 || internals == 0 || free == 0 {
+		t.Fatalf("got %d leaves, %d internal nodes and %d free blocks", leaves, internals, free)
+	}
+
+	// a node whose type and isleaf byte disagree is rejected
+	leaf, err := tree.firstLeafNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.writeAt([]byte{BLOCK_INTERNAL}, leaf.Self+4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.seekNode(leaf.Self); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+}
+
+func TestNodeMarshalBinary(t *testing.T) {
+	internal := &Node{
+		IsActive: true,
+		Self:     8192,
+		Next:     INVALID_OFFSET,
+		Prev:     4096,
+		Parent:   INVALID_OFFSET,
+		Children: []int64{12288, 16384},
+		Keys:     []int64{10, 20},
+		Values:   []string{},
+	}
+
+	for _, n := range []*Node{goldenNode(), internal} {
+		var m encoding.BinaryMarshaler = n
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := &Node{}
+		var u encoding.BinaryUnmarshaler = got
+		if err := u.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, n) {
+			t.Fatalf("got %+v, expected %+v", got, n)
+		}
+	}
+
+	// the same bytes as a tree of the current format writes
+	tree, err := NewTree(filepath.Join(t.TempDir(), "marshal.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	n := goldenNode()
+	if err := tree.flushNodeToDisk(n); err != nil {
+		t.Fatal(err)
+	}
+	block, err := tree.readBlock(n.Self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := n.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block[:len(data)], data) {
+		t.Fatalf("got %x, the tree wrote %x", data, block[:len(data)])
+	}
+
+	// older blocks decode as well
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "node.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Node{}
+	if err := got.UnmarshalBinary(golden); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, goldenNode()) {
+		t.Fatalf("got %+v, expected %+v", got, goldenNode())
+	}
+}
+
+func TestDecodeErrorNamesField(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "field.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	off := tree.rootOff
+
+	// datalen, type, isleaf, four offsets and the empty children come first
+	keysCntAt := off + 4 + 1 + 1 + 4*8 + 8
+	for _, c := range []struct {
+		cnt  int64
+		want string
+	}{
+		{-5, "keyscnt -5 is negative"},
+		{1 << 40, "keyscnt 1099511627776 does not fit"},
+	} {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(c.cnt))
+		if err := tree.writeAt(buf, keysCntAt); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := tree.seekNode(off)
+		if !errors.Is(err, ErrorInvalidDBFormat) {
+			t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+		}
+		if msg := err.Error(); !strings.Contains(msg, c.want) || !strings.Contains(msg, fmt.Sprintf("offset %d", off)) {
+			t.Fatalf("expected the error to name %q at offset %d, got %q", c.want, off, msg)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Option configures a Tree in NewTree
+type Option func(*Tree)
+
+// BlockSize sets the size of a node block on disk, BLOCK_SIZE by default.
+// Files from BLOCK_SIZE_VERSION on store their block size and are reopened
+// with it without this option, passing a different one fails with
+// ErrorBlockSizeMismatch. Older files must always be reopened with the block
+// size they were created with.
+func BlockSize(size uint32) Option {
+	return func(t *Tree) {
+		t.blockSize = size
+		t.blockSizeSet = true
+	}
+}
+
+// MinPrealloc sets how many free blocks are reserved ahead whenever the
+// tree runs out of them, MAX_FREEBLOCKS by default. Small values keep tiny
+// databases small at the cost of growing the file more often.
+func MinPrealloc(n int) Option {
+	return func(t *Tree) {
+		if n < 1 {
+			n = 1
+		}
+		t.prealloc = n
+	}
+}
+
+// FreeScanLimit makes opening a database look for free blocks in the last
+// n blocks of the file only, instead of reading the type of every block,
+// which takes long on huge files. There is no free list on disk to fall
+// back on: the free blocks before those are lost to the session, the file
+// grows instead of reusing them, and every later session opened with the
+// limit loses them too. Only a Compact or opening the file without the
+// limit gets that space back. No data is lost or overwritten.
+func FreeScanLimit(n int) Option {
+	return func(t *Tree) {
+		t.scanLimit = n
+	}
+}
+
+// DebugInvariants makes every node write check that the node's keys are
+// strictly increasing and fail with the node offset otherwise. It costs a
+// pass over the keys per write, so leave it off in production.
+func DebugInvariants() Option {
+	return func(t *Tree) {
+		t.debugInvariants = true
+	}
+}
+
+// StrictReads makes every node read check that its keys are in order and,
+// for an internal node, that it has as many children as keys, failing with
+// ErrorInvalidDBFormat otherwise. Without it such a node is used as it is
+// and lookups through it may silently go wrong.
+func StrictReads() Option {
+	return func(t *Tree) {
+		t.strictReads = true
+	}
+}
+
+// UniqueValues makes Insert, Update and everything writing a value fail
+// with ErrorDuplicateValue when the value is already stored under another
+// key. The values are kept in memory to check them, read from the whole
+// tree when it is opened; opening a tree that already holds a value twice
+// fails.
+func UniqueValues() Option {
+	return func(t *Tree) {
+		t.uniqueValues = true
+	}
+}
+
+// ZeroOnFree makes every freed block, node or overflow page, be written
+// over in full so that the keys and values it held do not linger on disk
+// until the block is reused. It costs a full block write per freed block.
+// Values kept in the side file of SeparateValues are not erased, nor is
+// what a node still in use held before it was last rewritten.
+func ZeroOnFree() Option {
+	return func(t *Tree) {
+		t.zeroOnFree = true
+	}
+}
+
+// RebuildFromLeaves makes NewTree check the tree structure and, if it is
+// broken, throw the internal nodes away and build them again bottom-up
+// from the leaf chain. It only helps when the leaves themselves are intact.
+// A leaf split cut short by a crash is repaired by linking the new leaf
+// into its parent, without a rebuild.
+func RebuildFromLeaves() Option {
+	return func(t *Tree) {
+		t.rebuildOnOpen = true
+	}
+}
+
+// CoalesceWrites holds up to maxBlocks written nodes in memory so that
+// repeated writes of the same block, like a parent updated once per insert
+// into its children, reach the file only once. The buffer is written out
+// when it overflows, on Flush and on Close; anything still buffered is lost
+// if the process dies.
+func CoalesceWrites(maxBlocks int) Option {
+	return func(t *Tree) {
+		t.coalesceLimit = maxBlocks
+	}
+}
+
+// ValueCompressor compresses leaf values of at least COMPRESS_MIN_SIZE bytes
+// with c. It only applies when the file is created: the choice is kept in
+// the header and an existing file always uses the one it was created with.
+func ValueCompressor(c Compression) Option {
+	return func(t *Tree) {
+		t.compression = c
+	}
+}
+
+// RepairOnOpen makes NewTree truncate a file whose size is not a multiple of
+// the block size down to its last full block, instead of failing with
+// ErrorInvalidDBFormat. Whatever was in the partial block is lost.
+func RepairOnOpen() Option {
+	return func(t *Tree) {
+		t.repairOnOpen = true
+	}
+}
+
+// UseMmap serves node reads from a read-only shared mapping of the file
+// instead of a ReadAt per node. The mapping is redone whenever the file
+// grows; writes still go through WriteAt. On platforms without mmap, and
+// for stores other than files, it has no effect.
+func UseMmap() Option {
+	return func(t *Tree) {
+		t.useMmap = true
+	}
+}
+
+// FileMode sets the permissions NewTree creates the file with, 0644 by
+// default. It has no effect on a file that already exists.
+func FileMode(mode os.FileMode) Option {
+	return func(t *Tree) {
+		t.fileMode = mode
+	}
+}
+
+// KeyValidator makes Insert, Update, Delete, Modify and transaction commits
+// call fn on every key they change and fail with its error if it returns one,
+// before anything is written.
+func KeyValidator(fn func(key int64) error) Option {
+	return func(t *Tree) {
+		t.keyValidator = fn
+	}
+}
+
+// MaxValueSize makes Insert, Update and everything writing a value fail
+// with ErrorValueTooLarge for values longer than n bytes, before anything
+// is written. Without it, values are only limited by what the file format
+// can store.
+func MaxValueSize(n int) Option {
+	return func(t *Tree) {
+		t.maxValueSize = n
+	}
+}
+
+// SyncInterval makes the tree call Sync every d in the background until
+// Close, bounding how much is lost on a crash without syncing every write.
+// The first error it runs into is returned by Close.
+func SyncInterval(d time.Duration) Option {
+	return func(t *Tree) {
+		t.syncInterval = d
+	}
+}
+
+// SeparateValues keeps leaf values in a side file named after the tree file
+// with VALUES_SUFFIX, and a generation number once compacted, see
+// valuesName, leaving only their offsets in the leaves. Leaves then
+// hold many more keys for a given block size, see Order, and key-only scans
+// like AllKeys never read the values. It only applies when the file is
+// created, the choice is kept in the header.
+func SeparateValues() Option {
+	return func(t *Tree) {
+		t.separateValues = true
+	}
+}
+
+// valuesGeneration makes a new file use the side file of generation gen,
+// see valuesName. Only Compact needs it.
+func valuesGeneration(gen uint32) Option {
+	return func(t *Tree) {
+		t.valuesGen = gen
+	}
+}
+
+// ExpertMode enables ReadNode and WriteNode, which give repair tools raw
+// access to the nodes on disk. Nothing checks what they write: a wrong
+// node corrupts the tree.
+func ExpertMode() Option {
+	return func(t *Tree) {
+		t.expertMode = true
+	}
+}
+
+// KeyOrder orders the keys by less instead of ascending, less must be a
+// strict weak order and stay the same for the life of the file. The
+// comparator cannot be stored, so the file keeps name instead, 1 to
+// MAX_KEY_ORDER_NAME bytes, and opening it under another name fails with
+// ErrorKeyOrderMismatch. Change the name whenever less changes.
+func KeyOrder(name string, less func(a, b int64) bool) Option {
+	return func(t *Tree) {
+		t.less = less
+		t.lessName = name
+	}
+}
+
+// Order sets the max number of keys in a node, ORDER by default
+func Order(n int) Option {
+	return func(t *Tree) {
+		if n < 2 {
+			n = 2
+		}
+		t.order = n
+	}
+}
+
+// options returns the options recreating a tree laid out like t
+func (t *Tree) options() []Option {
+	opts := []Option{
+		BlockSize(t.blockSize),
+		MinPrealloc(t.prealloc),
+		Order(t.order),
+		ValueCompressor(t.compression),
+	}
+	if t.separateValues {
+		opts = append(opts, SeparateValues())
+	}
+	if t.less != nil {
+		opts = append(opts, KeyOrder(t.lessName, t.less))
+	}
+
+	return opts
+}
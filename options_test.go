@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlockSize(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "blocksize.db")
+	tree, err := NewTree(filename, BlockSize(8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewTree(filename, BlockSize(8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if len(tree.freeBlocks) == 0 {
+		t.Fatal("no free blocks allocated")
+	}
+	for _, off := range tree.freeBlocks {
+		if off%8192 != 0 {
+			t.Fatalf("free offset %d is not 8192-aligned", off)
+		}
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+}
+
+func TestMinPrealloc(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prealloc.db")
+	tree, err := NewTree(filename, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the header and the root leaf
+	if tree.fileSize != 2*int64(tree.blockSize) {
+		t.Fatalf("expected a single reserved block after the header, fileSize is %d", tree.fileSize)
+	}
+	if len(tree.freeBlocks) != 0 {
+		t.Fatalf("expected no spare free blocks, got %v", tree.freeBlocks)
+	}
+
+	fstat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstat.Size() > 2*int64(tree.blockSize) {
+		t.Fatalf("file size %d exceeds the header and one block", fstat.Size())
+	}
+
+	if err := tree.Insert(2, "test2"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := tree.Find(2); err != nil || val != "test2" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func TestFreeScanLimit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sparse.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a hole of 100000 free blocks after the nodes
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, info.Size()+100000*BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(full.freeBlocks) < 100000 || full.reads < 100000 {
+		t.Fatalf("full scan: %d free blocks in %d reads", len(full.freeBlocks), full.reads)
+	}
+	full.Close()
+
+	tree, err = NewTree(filename, FreeScanLimit(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if len(tree.freeBlocks) > 64 || tree.reads > 200 {
+		t.Fatalf("limited scan: %d free blocks in %d reads", len(tree.freeBlocks), tree.reads)
+	}
+
+	for i := int64(101); i <= 300; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFreeScanLimitLeaks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leak.db")
+	tree, err := NewTree(filename, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// frees blocks all over the file
+	for i := int64(1); i <= 150; i++ {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, free, _, err := tree.SpaceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every session with the limit misses the free blocks before the tail
+	size := func() int64 {
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	for session := 0; session < 2; session++ {
+		tree, err = NewTree(filename, MinPrealloc(1), FreeScanLimit(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree.freeBlocks) >= free {
+			t.Fatalf("got %d free blocks, expected fewer than %d", len(tree.freeBlocks), free)
+		}
+
+		before := size()
+		for i := int64(1); i <= 20; i++ {
+			key := int64(1000*(session+1)) + i
+			if err := tree.Insert(key, fmt.Sprintf("test%d", key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if size() <= before {
+			t.Fatalf("session %d: expected the file to grow past %d, got %d", session, before, size())
+		}
+	}
+
+	// a full scan finds them again
+	tree, err = NewTree(filename, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, free, _, err = tree.SpaceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.freeBlocks) != free {
+		t.Fatalf("full scan: got %d free blocks, the file has %d", len(tree.freeBlocks), free)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and so does a Compact, with the limit
+	tree, err = NewTree(filename, MinPrealloc(1), FreeScanLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	before := size()
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size() >= before {
+		t.Fatalf("expected Compact to shrink the file from %d, got %d", before, size())
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugInvariants(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "debug.db"), DebugInvariants())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 100; i += 3 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node, err := tree.newNodeFromDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.IsLeaf = true
+	node.Keys = []int64{1, 3, 2}
+	node.Values = []string{"test1", "test3", "test2"}
+
+	err = tree.flushNodeToDisk(node)
+	if err == nil {
+		t.Fatal("expected an error for keys out of order")
+	}
+	if !strings.Contains(err.Error(), fmt.Sprint(node.Self)) {
+		t.Fatalf("error does not name the node offset %d: %v", node.Self, err)
+	}
+
+	// without the option the same node is written as is
+	tree.debugInvariants = false
+	if err := tree.flushNodeToDisk(node); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictReads(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "strict.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 40; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a leaf with two keys swapped and a root missing a child
+	leaf, err := tree.findLeafNode(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf.Keys[0], leaf.Keys[1] = leaf.Keys[1], leaf.Keys[0]
+	if err := tree.flushNodeToDisk(leaf); err != nil {
+		t.Fatal(err)
+	}
+	root, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Children = root.Children[:len(root.Children)-1]
+	root.Counts = root.Counts[:len(root.Children)]
+	if err := tree.flushNodeToDisk(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// by default the bad nodes are used as they are
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if _, err := tree.seekNode(leaf.Self); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	tree.strictReads = true
+	if _, err := tree.seekNode(leaf.Self); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("leaf: expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+	if _, err := tree.Find(1); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("root: expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+
+	// the root is read on open already
+	if _, err := NewTree(filename, StrictReads()); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("open: expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+}
+
+func TestZeroOnFree(t *testing.T) {
+	// without the option the deleted values are still in the file
+	for _, zero := range []bool{false, true} {
+		filename := filepath.Join(t.TempDir(), "zero.db")
+		opts := []Option{}
+		if zero {
+			opts = append(opts, ZeroOnFree())
+		}
+		tree, err := NewTree(filename, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the last value spills to overflow pages
+		secrets := []string{"secret-one", "secret-two", strings.Repeat("secret-big", 1000)}
+		for i, val := range secrets {
+			if err := tree.Insert(int64(i), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range secrets {
+			if err := tree.Delete(int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := bytes.Contains(data, []byte("secret-")); found == zero {
+			t.Fatalf("ZeroOnFree %v: found the deleted values %v", zero, found)
+		}
+
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	small, err := NewTree(filepath.Join(t.TempDir(), "small.db"), Order(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+
+	large, err := NewTree(filepath.Join(t.TempDir(), "large.db"), Order(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer large.Close()
+
+	for i := int64(1); i <= 5; i++ {
+		if err := small.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := large.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if h, err := small.Height(); err != nil || h != 2 {
+		t.Fatalf("order 4: expected the leaf to split, got height %d, %v", h, err)
+	}
+	if h, err := large.Height(); err != nil || h != 1 {
+		t.Fatalf("order 8: expected a single leaf, got height %d, %v", h, err)
+	}
+
+	for _, tree := range []*Tree{small, large} {
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mode.db")
+	tree, err := NewTree(filename, FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+
+	fstat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fstat.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected mode %v, got %v", os.FileMode(0600), mode)
+	}
+
+	// compaction replaces the file, the mode must survive it
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if fstat, err = os.Stat(filename); err != nil {
+		t.Fatal(err)
+	}
+	if mode := fstat.Mode().Perm(); mode != 0600 {
+		t.Fatalf("after compaction: expected mode %v, got %v", os.FileMode(0600), mode)
+	}
+}
+
+func TestKeyValidator(t *testing.T) {
+	errNegative := errors.New("negative key")
+	tree, err := NewTree(filepath.Join(t.TempDir(), "validator.db"), KeyValidator(func(key int64) error {
+		if key < 0 {
+			return errNegative
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Insert(-1, "test-1"); err != errNegative {
+		t.Fatalf("expected %v, got %v", errNegative, err)
+	}
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Update(-1, "test-1"); err != errNegative {
+		t.Fatalf("expected %v, got %v", errNegative, err)
+	}
+	if err := tree.Delete(-1); err != errNegative {
+		t.Fatalf("expected %v, got %v", errNegative, err)
+	}
+
+	txn := tree.Begin()
+	txn.Insert(2, "test2")
+	txn.Insert(-2, "test-2")
+	if err := txn.Commit(); err != errNegative {
+		t.Fatalf("expected %v, got %v", errNegative, err)
+	}
+
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != 1 {
+		t.Fatalf("expected only key 1, got %v", keys)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "maxvalue.db"), MaxValueSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	big := strings.Repeat("v", 101)
+	if err := tree.Insert(1, big); !errors.Is(err, ErrorValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrorValueTooLarge, err)
+	}
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Update(1, big); !errors.Is(err, ErrorValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrorValueTooLarge, err)
+	}
+	if _, _, err := tree.Put(1, big); !errors.Is(err, ErrorValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrorValueTooLarge, err)
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("expected the old value to be kept, got %q, %v", val, err)
+	}
+
+	if err := tree.Update(1, big[:100]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// OVERFLOW_PAGE is the type byte of a block holding a piece of a
+	// spilled value
+	OVERFLOW_PAGE = 2
+	// OVERFLOW_FLAG is set in the length of a spilled value, which is then
+	// followed by the offset of its first overflow page instead of the data
+	OVERFLOW_FLAG = 0x80000000
+	// OVERFLOW_VERSION is the first format version with overflow pages
+	OVERFLOW_VERSION = 2
+)
+
+// overflowRef remembers where a value kept out of its leaf was read from
+// or written to, so that an unchanged value is not written again and a
+// replaced one gives its pages back. first is the first overflow page, or
+// the offset in the side file of SeparateValues, which has no pages.
+type overflowRef struct {
+	first int64
+	pages []int64
+	val   string
+}
+
+// overflowThreshold is the largest encoded value kept inside a leaf. It
+// leaves room for a full leaf of such values in one block.
+func (t *Tree) overflowThreshold() int {
+	return (int(t.blockSize) - 62 - 12*t.order) / t.order
+}
+
+// spills tells if the encoded value goes to overflow pages, files older
+// than OVERFLOW_VERSION keep every value inline
+func (t *Tree) spills(data []byte) bool {
+	return t.version >= OVERFLOW_VERSION && len(data) > t.overflowThreshold()
+}
+
+// writeValue encodes the value for key into bs, inline or as a reference
+// to overflow pages or the side file. A value already stored out of line
+// is not written again.
+func (t *Tree) writeValue(bs *bytes.Buffer, n *Node, key int64, val string, refs map[int64]overflowRef) error {
+	data, err := t.packValue(val)
+	if err != nil {
+		return err
+	}
+
+	if !t.separateValues && !t.spills(data) {
+		if err := binary.Write(bs, binary.LittleEndian, uint32(len(data))); err != nil {
+			return err
+		}
+		return binary.Write(bs, binary.LittleEndian, data)
+	}
+
+	ref, ok := n.overflow[key]
+	if !ok || ref.val != val {
+		if t.separateValues {
+			off, err := t.appendValue(data)
+			if err != nil {
+				return err
+			}
+			ref = overflowRef{first: off, val: val}
+		} else {
+			pages, err := t.writeOverflowPages(data)
+			if err != nil {
+				return err
+			}
+			ref = overflowRef{first: pages[0], pages: pages, val: val}
+		}
+	}
+	refs[key] = ref
+
+	if err := binary.Write(bs, binary.LittleEndian, uint32(len(data))|OVERFLOW_FLAG); err != nil {
+		return err
+	}
+	return binary.Write(bs, binary.LittleEndian, ref.first)
+}
+
+// readOutOfLine reads size bytes of a value kept out of its leaf
+func (t *Tree) readOutOfLine(first int64, size int) ([]byte, *overflowRef, error) {
+	if t.separateValues {
+		data, err := t.readValue(first, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, &overflowRef{first: first}, nil
+	}
+
+	data, pages, err := t.readOverflowPages(first, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &overflowRef{first: first, pages: pages}, nil
+}
+
+// replaceOverflowRefs frees the pages n no longer refers to and records
+// the ones it does
+func (t *Tree) replaceOverflowRefs(n *Node, refs map[int64]overflowRef) error {
+	for key, ref := range n.overflow {
+		if kept, ok := refs[key]; ok && kept.first == ref.first {
+			continue
+		}
+		for _, off := range ref.pages {
+			if err := t.freeNode(&Node{Self: off}); err != nil {
+				return err
+			}
+		}
+	}
+
+	n.overflow = nil
+	if len(refs) > 0 {
+		n.overflow = refs
+	}
+
+	return nil
+}
+
+// writeOverflowPages stores data in a chain of pages, each one
+// [datalen uint32][OVERFLOW_PAGE uint8][next int64][data]
+func (t *Tree) writeOverflowPages(data []byte) ([]int64, error) {
+	// a page is no larger than a node may be
+	size := int(t.blockSize) - 17
+
+	var pages []int64
+	for rest := len(data); ; rest -= size {
+		node, err := t.newNodeFromDisk()
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, node.Self)
+		if rest <= size {
+			break
+		}
+	}
+
+	for i, off := range pages {
+		next := int64(INVALID_OFFSET)
+		if i < len(pages)-1 {
+			next = pages[i+1]
+		}
+
+		chunk := data[i*size:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		page := make([]byte, 13+len(chunk))
+		binary.LittleEndian.PutUint32(page, uint32(9+len(chunk)))
+		page[4] = OVERFLOW_PAGE
+		binary.LittleEndian.PutUint64(page[5:], uint64(next))
+		copy(page[13:], chunk)
+
+		if err := t.writeBlock(page, off); err != nil {
+			return nil, err
+		}
+	}
+
+	return pages, nil
+}
+
+// readOverflowPages reassembles size bytes from the chain starting at off
+func (t *Tree) readOverflowPages(off int64, size int) ([]byte, []int64, error) {
+	data := make([]byte, 0, size)
+
+	var pages []int64
+	for len(data) < size {
+		if off == INVALID_OFFSET {
+			return nil, nil, fmt.Errorf("%w: overflow chain ends after %d of %d bytes", ErrorInvalidDBFormat, len(data), size)
+		}
+
+		buf, err := t.readBlock(off)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dataLen := int(binary.LittleEndian.Uint32(buf))
+		if buf[4] != OVERFLOW_PAGE || dataLen < 9 || dataLen+4 > len(buf) {
+			return nil, nil, fmt.Errorf("%w: block at %d is not an overflow page", ErrorInvalidDBFormat, off)
+		}
+
+		pages = append(pages, off)
+		data = append(data, buf[13:4+dataLen]...)
+		off = int64(binary.LittleEndian.Uint64(buf[5:]))
+	}
+
+	if len(data) != size {
+		return nil, nil, fmt.Errorf("%w: overflow chain holds %d bytes, expected %d", ErrorInvalidDBFormat, len(data), size)
+	}
+
+	return data, pages, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func countOverflowPages(t *testing.T, tree *Tree) int {
+	t.Helper()
+
+	size, err := tree.storedSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnt := 0
+	for off := tree.dataOff; off < size; off += int64(tree.blockSize) {
+		node, err := tree.seekNode(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.overflowPage {
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+func TestOverflowValue(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "overflow.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := strings.Repeat("0123456789", 2000)
+	if err := tree.Insert(1, big); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(2, "small"); err != nil {
+		t.Fatal(err)
+	}
+	if pages := countOverflowPages(t, tree); pages != 5 {
+		t.Fatalf("expected 20000 bytes in 5 pages, got %d", pages)
+	}
+
+	// rewriting the leaf for another key keeps the pages
+	if err := tree.Update(2, "smaller"); err != nil {
+		t.Fatal(err)
+	}
+	if pages := countOverflowPages(t, tree); pages != 5 {
+		t.Fatalf("expected 5 pages, got %d", pages)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewTree(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if val, err := tree.Find(1); err != nil || val != big {
+		t.Fatalf("got %d bytes, %v", len(val), err)
+	}
+
+	// replacing or deleting the value gives its pages back
+	if err := tree.Update(1, big[:5000]); err != nil {
+		t.Fatal(err)
+	}
+	if pages := countOverflowPages(t, tree); pages != 2 {
+		t.Fatalf("expected 2 pages, got %d", pages)
+	}
+	if val, err := tree.Find(1); err != nil || val != big[:5000] {
+		t.Fatalf("got %d bytes, %v", len(val), err)
+	}
+
+	if err := tree.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if pages := countOverflowPages(t, tree); pages != 0 {
+		t.Fatalf("expected no pages left, got %d", pages)
+	}
+}
+
+func TestOverflowValuesAcrossSplits(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "overflow.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	value := func(i int64) string {
+		return strings.Repeat(fmt.Sprintf("%05d", i), 1000)
+	}
+
+	for i := int64(1); i <= 50; i++ {
+		if err := tree.Insert(i, value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 50; i += 2 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(2); i <= 50; i += 2 {
+		if val, err := tree.Find(i); err != nil || val != value(i) {
+			t.Fatalf("key %d: got %d bytes, %v", i, len(val), err)
+		}
+	}
+	if pages := countOverflowPages(t, tree); pages != 25*2 {
+		t.Fatalf("expected 2 pages for each of the 25 values, got %d", pages)
+	}
+}
@@ -0,0 +1,763 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RangeAfter returns up to limit pairs whose keys are strictly greater than
+// afterKey, in ascending order. Feed the last returned key back in to get
+// the next page.
+func (t *Tree) RangeAfter(afterKey int64, limit int) (_ []int64, _ []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	keys := make([]int64, 0)
+	vals := make([]string, 0)
+	if limit <= 0 {
+		return keys, vals, nil
+	}
+
+	err = t.ascend(afterKey, func(key int64, val string) bool {
+		if key == afterKey {
+			return true
+		}
+		keys = append(keys, key)
+		vals = append(vals, val)
+		return len(keys) < limit
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, vals, nil
+}
+
+// NextN returns the n pairs immediately following the given key in sorted
+// order, the key itself excluded. It is RangeAfter under a friendlier name.
+func (t *Tree) NextN(after int64, n int) ([]int64, []string, error) {
+	return t.RangeAfter(after, n)
+}
+
+// AllKeys returns every key in ascending order. It holds the whole key set
+// in memory, page through RangeAfter instead on large trees.
+func (t *Tree) AllKeys() (_ []int64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	keys := make([]int64, 0)
+	if t.rootOff == INVALID_OFFSET {
+		return keys, nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		keys = append(keys, leaf.Keys...)
+
+		if leaf.Next == INVALID_OFFSET {
+			return keys, nil
+		}
+
+		// the values are not needed, leave the ones out of line unread
+		if leaf, err = t.seekNodeKeys(leaf.Next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Neighbors returns up to before pairs with keys less than key and up to
+// after pairs with keys greater, all in ascending order. key itself is
+// left out whether it exists or not, and fewer pairs come back near the
+// ends of the tree.
+func (t *Tree) Neighbors(key int64, before, after int) (_ []int64, _ []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	keys := make([]int64, 0)
+	vals := make([]string, 0)
+	if before > 0 {
+		err = t.descend(key, func(k int64, val string) bool {
+			if k == key {
+				return true
+			}
+			keys = append(keys, k)
+			vals = append(vals, val)
+			return len(keys) < before
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+			vals[i], vals[j] = vals[j], vals[i]
+		}
+	}
+
+	if after > 0 {
+		n := len(keys)
+		err = t.ascend(key, func(k int64, val string) bool {
+			if k == key {
+				return true
+			}
+			keys = append(keys, k)
+			vals = append(vals, val)
+			return len(keys)-n < after
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return keys, vals, nil
+}
+
+// Min returns the smallest key in the key order of the tree along with its
+// value, ok is false on an empty tree
+func (t *Tree) Min() (key int64, val string, ok bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return 0, "", false, nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	return leaf.Keys[0], leaf.Values[0], true, nil
+}
+
+// Rank returns how many keys are strictly less than key, the position key
+// has or would have in AllKeys. It adds up the key counts of the internal
+// nodes on the way down to key, files older than SUBTREE_COUNT_VERSION
+// have none and walk the leaf chain up to key instead.
+func (t *Tree) Rank(key int64) (_ int, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return 0, nil
+	}
+
+	if !t.hasCounts() {
+		return t.rankFromLeaves(key)
+	}
+
+	return t.rankFromCounts(key)
+}
+
+// rankFromCounts is Rank following the key counts of the internal nodes
+// down to key
+func (t *Tree) rankFromCounts(key int64) (int, error) {
+	node, err := t.seekNodeKeys(t.rootOff)
+	if err != nil {
+		return 0, err
+	}
+
+	rank := int64(0)
+	for !node.IsLeaf {
+		idx := t.getIndex(node.Keys, key)
+		for _, c := range node.Counts[:idx] {
+			rank += c
+		}
+		// every key of the subtree is smaller
+		if idx == len(node.Keys) {
+			return int(rank), nil
+		}
+
+		if node, err = t.seekNodeKeys(node.child(idx)); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(rank) + t.getIndex(node.Keys, key), nil
+}
+
+func (t *Tree) rankFromLeaves(key int64) (int, error) {
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return 0, err
+	}
+
+	rank := 0
+	for {
+		idx := t.getIndex(leaf.Keys, key)
+		rank += idx
+		if idx < len(leaf.Keys) || leaf.Next == INVALID_OFFSET {
+			return rank, nil
+		}
+
+		if leaf, err = t.seekNodeKeys(leaf.Next); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Select returns the pair at position i, counted from 0, in AllKeys order,
+// or ErrorNotFoundKey if the tree has no more than i keys. Like Rank it
+// follows the key counts down, or walks the leaf chain on older files.
+func (t *Tree) Select(i int) (key int64, val string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET || i < 0 {
+		return 0, "", ErrorNotFoundKey
+	}
+
+	var leaf *Node
+	if t.hasCounts() {
+		leaf, i, err = t.selectLeaf(i)
+	} else {
+		leaf, i, err = t.selectLeafFromLeaves(i)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	// only the keys were read on the way
+	if leaf, err = t.seekNode(leaf.Self); err != nil {
+		return 0, "", err
+	}
+
+	return leaf.Keys[i], leaf.Values[i], nil
+}
+
+// selectLeaf returns the leaf holding the key at position i and where in
+// the leaf it is
+func (t *Tree) selectLeaf(i int) (*Node, int, error) {
+	node, err := t.seekNodeKeys(t.rootOff)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rest := int64(i)
+	for !node.IsLeaf {
+		idx := 0
+		for idx < len(node.Counts) && rest >= node.Counts[idx] {
+			rest -= node.Counts[idx]
+			idx++
+		}
+		if idx == len(node.Counts) {
+			return nil, 0, ErrorNotFoundKey
+		}
+
+		if node, err = t.seekNodeKeys(node.child(idx)); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if rest >= int64(len(node.Keys)) {
+		return nil, 0, ErrorNotFoundKey
+	}
+
+	return node, int(rest), nil
+}
+
+func (t *Tree) selectLeafFromLeaves(i int) (*Node, int, error) {
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i >= len(leaf.Keys) {
+		if leaf.Next == INVALID_OFFSET {
+			return nil, 0, ErrorNotFoundKey
+		}
+
+		i -= len(leaf.Keys)
+		if leaf, err = t.seekNodeKeys(leaf.Next); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return leaf, i, nil
+}
+
+// Floor returns the largest key <= the given one along with its value,
+// ok is false if every key is larger
+func (t *Tree) Floor(key int64) (foundKey int64, val string, ok bool, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return 0, "", false, nil
+	}
+
+	leaf, err := t.findLeafNode(key)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	idx := t.getIndex(leaf.Keys, key)
+	if idx < len(leaf.Keys) && leaf.Keys[idx] == key {
+		return key, leaf.Values[idx], true, nil
+	}
+
+	// every key of this leaf is larger, the floor is the end of the previous one
+	if idx == 0 {
+		if leaf.Prev == INVALID_OFFSET {
+			return 0, "", false, nil
+		}
+		if leaf, err = t.seekNode(leaf.Prev); err != nil {
+			return 0, "", false, err
+		}
+		idx = len(leaf.Keys)
+	}
+
+	return leaf.Keys[idx-1], leaf.Values[idx-1], true, nil
+}
+
+// RangeReverse returns the pairs with lo <= key <= hi in descending order
+func (t *Tree) RangeReverse(hi, lo int64) (_ []int64, _ []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	keys := make([]int64, 0)
+	vals := make([]string, 0)
+	if t.lessKey(hi, lo) {
+		return keys, vals, nil
+	}
+
+	err = t.descend(hi, func(key int64, val string) bool {
+		if t.lessKey(key, lo) {
+			return false
+		}
+		keys = append(keys, key)
+		vals = append(vals, val)
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, vals, nil
+}
+
+// RangeMap returns the pairs with lo <= key <= hi as a map, handy to look
+// keys of an interval up. The map loses the key order, use RangeReverse or
+// RangeAfter when it matters.
+func (t *Tree) RangeMap(lo, hi int64) (_ map[int64]string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	pairs := make(map[int64]string)
+	if t.lessKey(hi, lo) {
+		return pairs, nil
+	}
+
+	err = t.ascend(lo, func(key int64, val string) bool {
+		if t.lessKey(hi, key) {
+			return false
+		}
+		pairs[key] = val
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// Values returns the values of the keys with lo <= key <= hi in key order,
+// without the keys
+func (t *Tree) Values(lo, hi int64) (_ []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	vals := make([]string, 0)
+	if t.lessKey(hi, lo) {
+		return vals, nil
+	}
+
+	err = t.ascend(lo, func(key int64, val string) bool {
+		if t.lessKey(hi, key) {
+			return false
+		}
+		vals = append(vals, val)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return vals, nil
+}
+
+// MultiRange returns the keys with lo <= key <= hi of every [lo, hi] in
+// ranges, keyed by the range. It sorts the ranges and reads them all in a
+// single walk of the leaf chain from the lowest lo, instead of going down
+// from the root once per range; the leaves between two ranges are read
+// too, so ranges far apart are cheaper one by one. Ranges must not overlap,
+// an empty one with hi < lo gets no keys.
+func (t *Tree) MultiRange(ranges [][2]int64) (_ map[[2]int64][]int64, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	found := make(map[[2]int64][]int64)
+	sorted := make([][2]int64, 0, len(ranges))
+	for _, r := range ranges {
+		found[r] = make([]int64, 0)
+		if !t.lessKey(r[1], r[0]) {
+			sorted = append(sorted, r)
+		}
+	}
+	if len(sorted) == 0 {
+		return found, nil
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return t.lessKey(sorted[i][0], sorted[j][0])
+	})
+	for i := 1; i < len(sorted); i++ {
+		if !t.lessKey(sorted[i-1][1], sorted[i][0]) {
+			return nil, fmt.Errorf("ranges %v and %v overlap", sorted[i-1], sorted[i])
+		}
+	}
+
+	i := 0
+	err = t.ascend(sorted[0][0], func(key int64, val string) bool {
+		for t.lessKey(sorted[i][1], key) {
+			if i++; i == len(sorted) {
+				return false
+			}
+		}
+		if !t.lessKey(key, sorted[i][0]) {
+			found[sorted[i]] = append(found[sorted[i]], key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// ascend calls fn for every pair whose key >= from in ascending order,
+// following the leaf chain, until fn returns false
+func (t *Tree) ascend(from int64, fn func(key int64, val string) bool) error {
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	leaf, err := t.findLeafNode(from)
+	if err != nil {
+		return err
+	}
+
+	for i := t.getIndex(leaf.Keys, from); ; i = 0 {
+		for ; i < len(leaf.Keys); i++ {
+			if !fn(leaf.Keys[i], leaf.Values[i]) {
+				return nil
+			}
+		}
+
+		if leaf.Next == INVALID_OFFSET {
+			return nil
+		}
+
+		if leaf, err = t.seekNode(leaf.Next); err != nil {
+			return err
+		}
+	}
+}
+
+// ascendAll calls fn for every pair in ascending order until fn returns
+// false, from the head of the leaf chain whatever the key order
+func (t *Tree) ascendAll(fn func(key int64, val string) bool) error {
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	leaf, err := t.firstLeafNode()
+	if err != nil {
+		return err
+	}
+
+	return t.ascend(leaf.Keys[0], fn)
+}
+
+// descendAll calls fn for every pair in descending order until fn returns
+// false, from the tail of the leaf chain
+func (t *Tree) descendAll(fn func(key int64, val string) bool) error {
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	leaf, err := t.lastLeafNode()
+	if err != nil {
+		return err
+	}
+
+	return t.descend(leaf.Keys[len(leaf.Keys)-1], fn)
+}
+
+// descend calls fn for every pair whose key <= from in descending order,
+// following the leaf chain backwards, until fn returns false
+func (t *Tree) descend(from int64, fn func(key int64, val string) bool) error {
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	leaf, err := t.findLeafNode(from)
+	if err != nil {
+		return err
+	}
+
+	i := t.getIndex(leaf.Keys, from)
+	if i == len(leaf.Keys) || leaf.Keys[i] != from {
+		i--
+	}
+
+	for {
+		for ; i >= 0; i-- {
+			if !fn(leaf.Keys[i], leaf.Values[i]) {
+				return nil
+			}
+		}
+
+		if leaf.Prev == INVALID_OFFSET {
+			return nil
+		}
+
+		if leaf, err = t.seekNode(leaf.Prev); err != nil {
+			return err
+		}
+		i = len(leaf.Keys) - 1
+	}
+}
+
+// ESTIMATE_SAMPLE_LEAVES is how many leaves EstimateRange reads inwards
+// from each bound before extrapolating
+const ESTIMATE_SAMPLE_LEAVES = 4
+
+// EstimateRange returns an approximate number of keys with lo <= key <= hi.
+// It counts the keys of the few leaves next to each bound exactly and, if
+// the range spans more leaves than that, extrapolates the keys in between
+// from how densely keys are spread in the sampled leaves. The cost is
+// O(height + ESTIMATE_SAMPLE_LEAVES) whatever the size of the range, and the
+// result is close on evenly spread keys but can be far off on skewed data.
+// Under a KeyOrder the keys say nothing about how far apart they are: the
+// count is then exact from the key counts of the internal nodes, or on
+// files without them the leaves in between are estimated from the child
+// positions on the paths down to lo and hi, and taken to be as full as the
+// sampled ones. That reads the children of the nodes on both paths, which is
+// O(height * ORDER) but still does not grow with the range. Use a range scan
+// when an exact count is needed.
+func (t *Tree) EstimateRange(lo, hi int64) (_ int, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET || t.lessKey(hi, lo) {
+		return 0, nil
+	}
+
+	if t.less != nil && t.hasCounts() {
+		return t.countFromCounts(lo, hi)
+	}
+
+	fwd, err := t.findLeafNode(lo)
+	if err != nil {
+		return 0, err
+	}
+
+	back, err := t.findLeafNode(hi)
+	if err != nil {
+		return 0, err
+	}
+
+	cnt := 0
+	count := func(leaf *Node) {
+		for _, key := range leaf.Keys {
+			if !t.lessKey(key, lo) && !t.lessKey(hi, key) {
+				cnt++
+			}
+		}
+	}
+
+	count(fwd)
+	if fwd.Self == back.Self {
+		return cnt, nil
+	}
+	count(back)
+
+	fwdFirst, fwdKeys := fwd.Keys[0], len(fwd.Keys)
+	backLast, backKeys := back.Keys[len(back.Keys)-1], len(back.Keys)
+	sampled := 2
+	for i := 1; i < ESTIMATE_SAMPLE_LEAVES && fwd.Next != back.Self; i++ {
+		if fwd, err = t.seekNode(fwd.Next); err != nil {
+			return 0, err
+		}
+		count(fwd)
+		fwdKeys += len(fwd.Keys)
+		sampled++
+
+		if fwd.Next == back.Self {
+			break
+		}
+
+		if back, err = t.seekNode(back.Prev); err != nil {
+			return 0, err
+		}
+		count(back)
+		backKeys += len(back.Keys)
+		sampled++
+	}
+
+	// every leaf of the range has been counted
+	if fwd.Next == back.Self {
+		return cnt, nil
+	}
+
+	if t.less != nil {
+		leaves, err := t.leavesBetween(lo, hi)
+		if err != nil {
+			return 0, err
+		}
+		// the sampled leaves are between the leaves of lo and hi as well
+		if leaves -= float64(sampled - 2); leaves < 0 {
+			leaves = 0
+		}
+		fill := float64(fwdKeys+backKeys) / float64(sampled)
+		return cnt + int(leaves*fill+0.5), nil
+	}
+
+	// the sampled leaves tell how many keys per unit of key space there are,
+	// the differences are taken in float64 as they overflow int64 for keys
+	// far apart
+	fwdLast := fwd.Keys[len(fwd.Keys)-1]
+	backFirst := back.Keys[0]
+	gaps := float64(fwdKeys - 1 + backKeys - 1)
+	span := float64(fwdLast) - float64(fwdFirst) + float64(backLast) - float64(backFirst)
+	if span != 0 {
+		cnt += int(gaps/span*(float64(backFirst)-float64(fwdLast))+0.5) - 1
+	}
+
+	return cnt, nil
+}
+
+// countFromCounts returns the exact number of keys with lo <= key <= hi
+// from the key counts of the internal nodes
+func (t *Tree) countFromCounts(lo, hi int64) (int, error) {
+	below, err := t.rankFromCounts(lo)
+	if err != nil {
+		return 0, err
+	}
+	upTo, err := t.rankFromCounts(hi)
+	if err != nil {
+		return 0, err
+	}
+
+	leaf, err := t.findLeafNode(hi)
+	if err != nil {
+		return 0, err
+	}
+	if i := t.getIndex(leaf.Keys, hi); i < len(leaf.Keys) && leaf.Keys[i] == hi {
+		upTo++
+	}
+
+	return upTo - below, nil
+}
+
+// leafPath returns the nodes on the way down to the leaf a lookup of key
+// ends in, from the root, and the position of the child followed in each
+func (t *Tree) leafPath(key int64) (path []*Node, pos []int, err error) {
+	node, err := t.seekNodeKeys(t.rootOff)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for !node.IsLeaf {
+		idx := t.getIndex(node.Keys, key)
+		if idx == len(node.Keys) {
+			idx = len(node.Keys) - 1
+		}
+		path = append(path, node)
+		pos = append(pos, idx)
+
+		if node, err = t.seekNodeKeys(node.child(idx)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return path, pos, nil
+}
+
+// leavesBetween estimates how many leaves lie strictly between the leaves
+// of lo and hi from the paths down to them. The nodes on the paths give the
+// children left and right of the path exactly; a subtree hanging off them
+// is taken to branch on each level as much as the children of the path
+// nodes one level up do on average.
+func (t *Tree) leavesBetween(lo, hi int64) (float64, error) {
+	loPath, loPos, err := t.leafPath(lo)
+	if err != nil {
+		return 0, err
+	}
+	hiPath, hiPos, err := t.leafPath(hi)
+	if err != nil {
+		return 0, err
+	}
+	if len(loPath) != len(hiPath) {
+		return 0, fmt.Errorf("%w: leaves at depths %d and %d", ErrorInvalidDBFormat, len(loPath)+1, len(hiPath)+1)
+	}
+	depth := len(loPath)
+
+	// the lowest common ancestor is where the paths part
+	lca := 0
+	for lca < depth && loPos[lca] == hiPos[lca] {
+		lca++
+	}
+	if lca == depth {
+		return 0, nil
+	}
+
+	// leaves[l] is how many leaves a subtree rooted at depth l has
+	leaves := make([]float64, depth+1)
+	leaves[depth] = 1
+	for l := depth - 1; l > lca; l-- {
+		parents := []*Node{loPath[l-1]}
+		if l-1 > lca {
+			parents = append(parents, hiPath[l-1])
+		}
+		nodes, children := 0, 0
+		for _, parent := range parents {
+			for i := range parent.Children {
+				child, err := t.seekNodeKeys(parent.child(i))
+				if err != nil {
+					return 0, err
+				}
+				nodes++
+				children += len(child.Children)
+			}
+		}
+		leaves[l] = leaves[l+1] * float64(children) / float64(nodes)
+	}
+
+	between := float64(hiPos[lca]-loPos[lca]-1) * leaves[lca+1]
+	for l := lca + 1; l < depth; l++ {
+		right := len(loPath[l].Children) - loPos[l] - 1
+		between += float64(right+hiPos[l]) * leaves[l+1]
+	}
+
+	return between, nil
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newRangeTestTree(t *testing.T, n int64) *Tree {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "range.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= n; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tree
+}
+
+func TestRangeAfter(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	next := int64(1)
+	after := int64(0)
+	for {
+		keys, vals, err := tree.RangeAfter(after, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if len(keys) > 10 {
+			t.Fatalf("page after %d has %d keys", after, len(keys))
+		}
+
+		for i, key := range keys {
+			if key != next {
+				t.Fatalf("expected key %d, got %d", next, key)
+			}
+			if vals[i] != fmt.Sprintf("test%d", key) {
+				t.Fatalf("key %d: got %q", key, vals[i])
+			}
+			next++
+		}
+		after = keys[len(keys)-1]
+	}
+
+	if next != 101 {
+		t.Fatalf("paging stopped at %d", next)
+	}
+
+	for _, after := range []int64{100, math.MaxInt64} {
+		keys, _, err := tree.RangeAfter(after, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 {
+			t.Fatalf("expected no keys after %d, got %v", after, keys)
+		}
+	}
+}
+
+func TestNextN(t *testing.T) {
+	tree := newRangeTestTree(t, 1000)
+	defer tree.Close()
+
+	keys, vals, err := tree.NextN(500, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 5 {
+		t.Fatalf("expected 5 keys, got %v", keys)
+	}
+	for i, key := range keys {
+		if key != int64(501+i) {
+			t.Fatalf("expected %d at %d, got %d", 501+i, i, key)
+		}
+		if vals[i] != fmt.Sprintf("test%d", key) {
+			t.Fatalf("key %d: got %q", key, vals[i])
+		}
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	tree := newRangeTestTree(t, 0)
+	defer tree.Close()
+
+	if keys, err := tree.AllKeys(); err != nil || len(keys) != 0 {
+		t.Fatalf("empty tree: got %v, %v", keys, err)
+	}
+
+	deleted := map[int64]bool{-150: true, 0: true, 300: true}
+	var want []int64
+	for i := int64(-150); i <= 300; i += 3 {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if !deleted[i] {
+			want = append(want, i)
+		}
+	}
+	for key := range deleted {
+		if err := tree.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %v, expected %v", keys, want)
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	cases := []struct {
+		key           int64
+		before, after int
+		want          []int64
+	}{
+		{key: 50, before: 3, after: 2, want: []int64{47, 48, 49, 51, 52}},
+		{key: 1, before: 3, after: 2, want: []int64{2, 3}},      // at the minimum
+		{key: -5, before: 3, after: 2, want: []int64{1, 2}},     // below the minimum
+		{key: 99, before: 1, after: 5, want: []int64{98, 100}},  // near the maximum
+		{key: 500, before: 2, after: 2, want: []int64{99, 100}}, // past the maximum
+		{key: 50, before: 0, after: 0, want: []int64{}},
+	}
+
+	for _, c := range cases {
+		keys, vals, err := tree.Neighbors(c.key, c.before, c.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, c.want) {
+			t.Fatalf("Neighbors(%d, %d, %d): got %v, expected %v", c.key, c.before, c.after, keys, c.want)
+		}
+		for i, key := range keys {
+			if vals[i] != fmt.Sprintf("test%d", key) {
+				t.Fatalf("key %d: got %q", key, vals[i])
+			}
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	cases := map[int64]int{50: 49, 1: 0, 0: 0, 100: 99, 101: 100, math.MaxInt64: 100}
+	for key, want := range cases {
+		if rank, err := tree.Rank(key); err != nil || rank != want {
+			t.Fatalf("Rank(%d): expected %d, got %d, %v", key, want, rank, err)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	cases := map[int]int64{0: 1, 49: 50, 99: 100}
+	for i, want := range cases {
+		key, val, err := tree.Select(i)
+		if err != nil || key != want || val != fmt.Sprintf("test%d", want) {
+			t.Fatalf("Select(%d): expected %d, got %d, %q, %v", i, want, key, val, err)
+		}
+	}
+
+	if _, _, err := tree.Select(100); err != ErrorNotFoundKey {
+		t.Fatalf("expected %v past the last key, got %v", ErrorNotFoundKey, err)
+	}
+}
+
+// checkRankSelect compares Rank and Select with the sorted keys
+func checkRankSelect(t *testing.T, tree *Tree, keys []int64) {
+	t.Helper()
+
+	for key := keys[0] - 1; key <= keys[len(keys)-1]+1; key++ {
+		want := sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+		if rank, err := tree.Rank(key); err != nil || rank != want {
+			t.Fatalf("Rank(%d): expected %d, got %d, %v", key, want, rank, err)
+		}
+	}
+
+	for i, want := range keys {
+		key, val, err := tree.Select(i)
+		if err != nil || key != want || val != fmt.Sprintf("test%d", want) {
+			t.Fatalf("Select(%d): expected %d, got %d, %q, %v", i, want, key, val, err)
+		}
+	}
+	for _, i := range []int{-1, len(keys)} {
+		if _, _, err := tree.Select(i); err != ErrorNotFoundKey {
+			t.Fatalf("Select(%d): expected %v, got %v", i, ErrorNotFoundKey, err)
+		}
+	}
+}
+
+func TestRankSelectCounts(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "counts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	r := rand.New(rand.NewSource(1))
+	present := make(map[int64]bool)
+	for _, k := range r.Perm(500) {
+		key := int64(k)
+		if err := tree.Insert(key, fmt.Sprintf("test%d", key)); err != nil {
+			t.Fatal(err)
+		}
+		present[key] = true
+	}
+	for _, k := range r.Perm(500)[:300] {
+		key := int64(k)
+		if err := tree.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(present, key)
+	}
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]int64, 0, len(present))
+	for key := range present {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	checkRankSelect(t, tree, keys)
+
+	// files without counts walk the leaves
+	tree.Close()
+	old, err := NewTree(filepath.Join(t.TempDir(), "old.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	old.version = KEY_ORDER_VERSION
+	for _, key := range keys {
+		if err := old.Insert(key, fmt.Sprintf("test%d", key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if old.hasCounts() {
+		t.Fatal("expected no counts before SUBTREE_COUNT_VERSION")
+	}
+	checkRankSelect(t, old, keys)
+}
+
+func TestFloor(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "floor.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if _, _, ok, err := tree.Floor(10); ok || err != nil {
+		t.Fatalf("empty tree: got %v, %v", ok, err)
+	}
+
+	for i := int64(10); i <= 1000; i += 10 {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		key   int64
+		found int64
+		ok    bool
+	}{
+		{key: 55, found: 50, ok: true},     // between keys
+		{key: 501, found: 500, ok: true},   // between keys
+		{key: 60, found: 60, ok: true},     // equal
+		{key: 1000, found: 1000, ok: true}, // equal to the maximum
+		{key: 5000, found: 1000, ok: true}, // above the maximum
+		{key: 10, found: 10, ok: true},     // equal to the minimum
+		{key: 9, ok: false},                // below the minimum
+	}
+
+	for _, c := range cases {
+		found, val, ok, err := tree.Floor(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.ok || found != c.found {
+			t.Fatalf("Floor(%d): expected %d, %v, got %d, %v", c.key, c.found, c.ok, found, ok)
+		}
+		if ok && val != fmt.Sprintf("test%d", found) {
+			t.Fatalf("Floor(%d): got value %q", c.key, val)
+		}
+	}
+
+	// some of these floors sit at the end of the previous leaf
+	for i := int64(10); i < 1000; i += 10 {
+		if found, _, ok, err := tree.Floor(i + 1); err != nil || !ok || found != i {
+			t.Fatalf("Floor(%d): got %d, %v, %v", i+1, found, ok, err)
+		}
+	}
+}
+
+func TestRangeReverse(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	keys, vals, err := tree.RangeReverse(30, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 11 {
+		t.Fatalf("expected 11 keys, got %v", keys)
+	}
+	for i, key := range keys {
+		if key != int64(30-i) {
+			t.Fatalf("expected %d at %d, got %d", 30-i, i, key)
+		}
+		if vals[i] != fmt.Sprintf("test%d", key) {
+			t.Fatalf("key %d: got %q", key, vals[i])
+		}
+	}
+
+	// bounds outside of the stored keys
+	if keys, _, err = tree.RangeReverse(1000, 95); err != nil || len(keys) != 6 || keys[0] != 100 {
+		t.Fatalf("got %v, %v", keys, err)
+	}
+	if keys, _, err = tree.RangeReverse(5, -10); err != nil || len(keys) != 5 || keys[4] != 1 {
+		t.Fatalf("got %v, %v", keys, err)
+	}
+
+	if keys, _, err = tree.RangeReverse(20, 30); err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys for hi < lo, got %v, %v", keys, err)
+	}
+}
+
+func TestRangeMap(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	for _, c := range [][2]int64{{20, 30}, {95, 1000}, {-10, 5}, {50, 50}, {30, 20}} {
+		lo, hi := c[0], c[1]
+
+		pairs, err := tree.RangeMap(lo, hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, vals, err := tree.RangeReverse(hi, lo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make(map[int64]string, len(keys))
+		for i, key := range keys {
+			want[key] = vals[i]
+		}
+		if !reflect.DeepEqual(pairs, want) {
+			t.Fatalf("[%d, %d]: got %v, expected %v", lo, hi, pairs, want)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	tree := newRangeTestTree(t, 100)
+	defer tree.Close()
+
+	vals, err := tree.Values(10, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"test10", "test11", "test12"}; !reflect.DeepEqual(vals, want) {
+		t.Fatalf("got %v, expected %v", vals, want)
+	}
+
+	if vals, err = tree.Values(99, 1000); err != nil || len(vals) != 2 {
+		t.Fatalf("got %v, %v", vals, err)
+	}
+	if vals, err = tree.Values(12, 10); err != nil || len(vals) != 0 {
+		t.Fatalf("expected no values for hi < lo, got %v, %v", vals, err)
+	}
+}
+
+func TestEstimateRange(t *testing.T) {
+	// large enough leaves for the sampled density to be meaningful
+	tree, err := NewTree(filepath.Join(t.TempDir(), "estimate.db"), Order(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// 1000 keys spread uniformly over [0, 100000)
+	r := rand.New(rand.NewSource(1))
+	keys := make([]int64, 0, 1000)
+	for _, k := range r.Perm(100000)[:1000] {
+		keys = append(keys, int64(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		if err := tree.Insert(key, fmt.Sprintf("test%d", key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := [][2]int64{{0, 100000}, {10000, 40000}, {25000, 75000}, {60000, 120000}, {-5000, 30000}, {50000, 55000}}
+	for _, c := range cases {
+		lo, hi := c[0], c[1]
+
+		exact := 0
+		for _, key := range keys {
+			if key >= lo && key <= hi {
+				exact++
+			}
+		}
+
+		est, err := tree.EstimateRange(lo, hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff := est - exact
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > exact/5+5 {
+			t.Fatalf("EstimateRange(%d, %d) = %d, exact count is %d", lo, hi, est, exact)
+		}
+	}
+
+	if est, err := tree.EstimateRange(200000, 300000); err != nil || est != 0 {
+		t.Fatalf("expected 0 past the last key, got %d, %v", est, err)
+	}
+	if est, err := tree.EstimateRange(30000, 20000); err != nil || est != 0 {
+		t.Fatalf("expected 0 for hi < lo, got %d, %v", est, err)
+	}
+}
+
+func TestEstimateRangeExtremeKeys(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "extreme.db"), Order(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// 600 keys spread evenly from MinInt64 to near MaxInt64, their
+	// differences overflow int64
+	step := uint64(math.MaxUint64 / 600)
+	for i := uint64(0); i < 600; i++ {
+		key := int64(1<<63 + i*step)
+		if err := tree.Insert(key, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		lo, hi int64
+		exact  int
+	}{
+		{math.MinInt64, math.MaxInt64, 600},
+		{math.MinInt64, -1, 300},
+		{0, math.MaxInt64, 300},
+	} {
+		est, err := tree.EstimateRange(c.lo, c.hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := est - c.exact; diff > c.exact/5+5 || -diff > c.exact/5+5 {
+			t.Fatalf("EstimateRange(%d, %d) = %d, exact count is %d", c.lo, c.hi, est, c.exact)
+		}
+	}
+}
+
+func TestEstimateRangeKeyOrder(t *testing.T) {
+	// the distance between two keys says nothing about their positions
+	scrambled := func(a, b int64) bool { return a^0x5a5 < b^0x5a5 }
+	tree, err := NewTreeCmp(filepath.Join(t.TempDir(), "estimatecmp.db"), "scrambled", scrambled, Order(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(2000) {
+		if err := tree.Insert(int64(i), "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := [][2]int{{100, 1900}, {0, 1999}, {950, 1000}, {500, 500}}
+	for _, c := range ranges {
+		exact := c[1] - c[0] + 1
+		est, err := tree.EstimateRange(keys[c[0]], keys[c[1]])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est != exact {
+			t.Fatalf("EstimateRange(%d, %d) = %d, exact count is %d", keys[c[0]], keys[c[1]], est, exact)
+		}
+	}
+
+	// without key counts the leaves in between are estimated from the paths
+	tree.version = KEY_ORDER_VERSION
+	defer func() { tree.version = DB_VERSION }()
+	for _, c := range ranges {
+		exact := c[1] - c[0] + 1
+		est, err := tree.EstimateRange(keys[c[0]], keys[c[1]])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := est - exact; diff > exact/5+5 || -diff > exact/5+5 {
+			t.Fatalf("EstimateRange(%d, %d) = %d, exact count is %d", keys[c[0]], keys[c[1]], est, exact)
+		}
+	}
+}
+
+func TestMultiRange(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "multirange.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 60; i += 2 {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := tree.MultiRange([][2]int64{{20, 30}, {1, 5}, {50, 100}, {8, 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[2]int64][]int64{
+		{1, 5}:    {1, 3, 5},
+		{20, 30}:  {21, 23, 25, 27, 29},
+		{50, 100}: {51, 53, 55, 57, 59},
+		{8, 6}:    {},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+
+	if _, err := tree.MultiRange([][2]int64{{1, 10}, {10, 20}}); err == nil {
+		t.Fatal("expected an error for overlapping ranges")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// corruptNode is the panic raised by tree code walking a node read from
+// the file that cannot be walked, like an internal node without the child
+// a lookup leads to. It is the only panic recoverCorrupt turns into an
+// error.
+type corruptNode struct {
+	err error
+}
+
+// child returns the offset of the i-th child of n, raising corruptNode if
+// n has no such child
+func (n *Node) child(i int) int64 {
+	if i < 0 || i >= len(n.Children) {
+		panic(corruptNode{fmt.Errorf("%w: node at %d has no child %d, it has %d children and %d keys", ErrorInvalidDBFormat, n.Self, i, len(n.Children), len(n.Keys))})
+	}
+	return n.Children[i]
+}
+
+// value returns the i-th value of the leaf n, raising corruptNode if n
+// has no such value
+func (n *Node) value(i int) string {
+	if i < 0 || i >= len(n.Values) {
+		panic(corruptNode{fmt.Errorf("%w: node at %d has no value %d, it has %d values and %d keys", ErrorInvalidDBFormat, n.Self, i, len(n.Values), len(n.Keys))})
+	}
+	return n.Values[i]
+}
+
+// setKey sets the i-th key of n, raising corruptNode if n has no such key
+func (n *Node) setKey(i int, key int64) {
+	if i < 0 || i >= len(n.Keys) {
+		panic(corruptNode{fmt.Errorf("%w: node at %d has no key %d, it has %d keys", ErrorInvalidDBFormat, n.Self, i, len(n.Keys))})
+	}
+	n.Keys[i] = key
+}
+
+// addCount adds delta to the key count of the i-th child of n, raising
+// corruptNode if n has no count for it
+func (n *Node) addCount(i int, delta int64) {
+	if i < 0 || i >= len(n.Counts) {
+		panic(corruptNode{fmt.Errorf("%w: node at %d has no count %d, it has %d counts and %d children", ErrorInvalidDBFormat, n.Self, i, len(n.Counts), len(n.Children))})
+	}
+	n.Counts[i] += delta
+}
+
+// recoverCorrupt is deferred by the exported methods that walk nodes read
+// from the file. A corruptNode panic raised deep in the tree code becomes
+// the error of the method, with the stack it was raised from, instead of
+// crashing the caller. Any other panic,
+// from a bug in the tree or from code supplied by the caller like a Modify
+// function, a KeyValidator or a KeyOrder comparator, is raised again as it
+// is: it says nothing about the file.
+func recoverCorrupt(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	c, ok := r.(corruptNode)
+	if !ok {
+		panic(r)
+	}
+	*err = fmt.Errorf("%w\n%s", c.err, debug.Stack())
+}
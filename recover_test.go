@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecoverCorrupt(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "corrupt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 20; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an internal root without keys has no child to descend into
+	root, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.IsLeaf {
+		t.Fatal("expected the root to be an internal node")
+	}
+	root.Keys = nil
+	if err := tree.flushNodeToDisk(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert(21, "test21"); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+	if _, err := tree.Find(1); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+
+	// the lock is released after a recovered panic
+	if _, err := tree.Height(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverCorruptRepanics(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "repanic.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a bug in the caller's function is not file corruption
+	bug := errors.New("bug in the caller")
+	func() {
+		defer func() {
+			if r := recover(); r != bug {
+				t.Fatalf("expected the caller's panic, got %v", r)
+			}
+		}()
+		tree.Modify(1, func(old string, exists bool) (string, bool) {
+			panic(bug)
+		})
+		t.Fatal("expected Modify to panic")
+	}()
+
+	// the lock is released and nothing was written
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
+
+func TestLeafValuesMismatch(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "mismatch.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a leaf with three keys but a single value
+	leaf, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf.Values = leaf.Values[:1]
+	if err := tree.flushNodeToDisk(leaf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tree.Find(3); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+	if _, err := tree.Fingerprint(); !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+}
+
+func TestRecoverCorruptMissingCounts(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "counts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 20; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an internal root written without the key counts of its children
+	root, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.version = BLOCK_TYPE_VERSION
+	root.Counts = nil
+	err = tree.flushNodeToDisk(root)
+	tree.version = DB_VERSION
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tree.Insert(21, "test21")
+	if !errors.Is(err, ErrorInvalidDBFormat) {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+	// the stack tells where the node could not be walked
+	if !strings.Contains(err.Error(), "addToCounts") {
+		t.Fatalf("expected the stack in the error, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SELFTEST_KEYS is how many keys SelfTest goes through, enough for a few
+// levels with the default order
+const SELFTEST_KEYS = 200
+
+// SelfTest is a smoke test of the tree on its own file: it inserts a known
+// sequence, reads it back with Find and range scans, deletes it again and
+// checks the structure at every step. The tree must be empty, and is
+// empty again when SelfTest returns.
+func (t *Tree) SelfTest() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff != INVALID_OFFSET {
+		return fmt.Errorf("self test on %s: database is not empty", t.file.Name())
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// leave as little as possible behind, the test already failed
+		for key := int64(1); key <= SELFTEST_KEYS; key++ {
+			t.deleteKey(key)
+		}
+	}()
+
+	val := func(key int64) string {
+		return fmt.Sprintf("selftest%d", key)
+	}
+
+	for key := int64(1); key <= SELFTEST_KEYS; key++ {
+		if err := t.insert(key, val(key)); err != nil {
+			return fmt.Errorf("self test: insert %d: %w", key, err)
+		}
+	}
+	if err := t.selfTestCheck(1, 1); err != nil {
+		return err
+	}
+
+	for key := int64(1); key <= SELFTEST_KEYS; key += 2 {
+		if err := t.deleteKey(key); err != nil {
+			return fmt.Errorf("self test: delete %d: %w", key, err)
+		}
+	}
+	if err := t.selfTestCheck(2, 2); err != nil {
+		return err
+	}
+
+	for key := int64(2); key <= SELFTEST_KEYS; key += 2 {
+		if err := t.deleteKey(key); err != nil {
+			return fmt.Errorf("self test: delete %d: %w", key, err)
+		}
+	}
+	if t.rootOff != INVALID_OFFSET {
+		return fmt.Errorf("self test: tree not empty after deleting every key")
+	}
+
+	return nil
+}
+
+// selfTestCheck checks that the tree holds exactly the keys first,
+// first+step, ... up to SELFTEST_KEYS with their SelfTest values
+func (t *Tree) selfTestCheck(first, step int64) error {
+	if err := t.verify(); err != nil {
+		return fmt.Errorf("self test: %w", err)
+	}
+
+	for key := int64(1); key <= SELFTEST_KEYS; key++ {
+		want := fmt.Sprintf("selftest%d", key)
+		if (key-first)%step != 0 {
+			want = ""
+		}
+
+		got, err := t.find(key)
+		switch {
+		case want == "" && err != ErrorNotFoundKey:
+			return fmt.Errorf("self test: find deleted %d: got %q, %v", key, got, err)
+		case want != "" && (err != nil || got != want):
+			return fmt.Errorf("self test: find %d: got %q, %v", key, got, err)
+		}
+	}
+
+	// the scans follow the key order of the tree, not necessarily ascending
+	var want []int64
+	for key := first; key <= SELFTEST_KEYS; key += step {
+		want = append(want, key)
+	}
+	sort.Slice(want, func(i, j int) bool { return t.lessKey(want[i], want[j]) })
+
+	i := 0
+	err := t.ascendAll(func(key int64, val string) bool {
+		if i == len(want) || key != want[i] || val != fmt.Sprintf("selftest%d", key) {
+			return false
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("self test: ascend: %w", err)
+	}
+	if i < len(want) {
+		return fmt.Errorf("self test: ascend stopped before %d", want[i])
+	}
+
+	i = len(want) - 1
+	err = t.descendAll(func(key int64, val string) bool {
+		if i < 0 || key != want[i] || val != fmt.Sprintf("selftest%d", key) {
+			return false
+		}
+		i--
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("self test: descend: %w", err)
+	}
+	if i >= 0 {
+		return fmt.Errorf("self test: descend stopped at %d", want[i])
+	}
+
+	return nil
+}
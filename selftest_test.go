@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "selftest.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.rootOff != INVALID_OFFSET {
+		t.Fatal("expected the tree to be empty again")
+	}
+
+	if err := tree.Insert(1, "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SelfTest(); err == nil {
+		t.Fatal("expected SelfTest to refuse a non empty tree")
+	}
+	if val, err := tree.Find(1); err != nil || val != "test1" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
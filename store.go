@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrorNotAFile = errors.New("store is not a file")
+
+// BlockStore is the storage a Tree keeps its blocks in. Files opened by
+// NewTree and NewTreeFromFile are used through it, other backends can be
+// plugged in with NewTreeFromStore. Name is only used in error messages.
+type BlockStore interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Size() (int64, error)
+	Close() error
+	Name() string
+}
+
+// fileStore is the BlockStore of an *os.File
+type fileStore struct {
+	*os.File
+}
+
+func (f fileStore) Size() (int64, error) {
+	fstat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fstat.Size(), nil
+}
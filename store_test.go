@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// memStore keeps the blocks in memory, Close leaves them there so that a
+// tree can be opened again on the same store
+type memStore struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memStore) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memStore) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *memStore) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size <= int64(len(m.data)) {
+		m.data = m.data[:size]
+	} else {
+		m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	}
+	return nil
+}
+
+func (m *memStore) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return int64(len(m.data)), nil
+}
+
+func (m *memStore) Sync() error  { return nil }
+func (m *memStore) Close() error { return nil }
+func (m *memStore) Name() string { return "memory" }
+
+func TestMemStore(t *testing.T) {
+	store := &memStore{}
+	tree, err := NewTreeFromStore(store, UseMmap())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 300; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 300; i += 5 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Update(2, "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Compact(); !errors.Is(err, ErrorNotAFile) {
+		t.Fatalf("expected %v, got %v", ErrorNotAFile, err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree, err = NewTreeFromStore(store); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 300; i++ {
+		val, err := tree.Find(i)
+		switch {
+		case i%5 == 1:
+			if err != ErrorNotFoundKey {
+				t.Fatalf("key %d: expected %v, got %v", i, ErrorNotFoundKey, err)
+			}
+		case i == 2:
+			if err != nil || val != "updated" {
+				t.Fatalf("key %d: got %q, %v", i, val, err)
+			}
+		default:
+			if err != nil || val != fmt.Sprintf("test%d", i) {
+				t.Fatalf("key %d: got %q, %v", i, val, err)
+			}
+		}
+	}
+}
+
+// eofStore counts the reads starting at or past the end of the data
+type eofStore struct {
+	memStore
+	pastEOF int
+}
+
+func (s *eofStore) ReadAt(p []byte, off int64) (int, error) {
+	if size, _ := s.Size(); off >= size {
+		s.pastEOF++
+	}
+	return s.memStore.ReadAt(p, off)
+}
+
+func TestReadPastEOF(t *testing.T) {
+	store := &eofStore{}
+	tree, err := NewTreeFromStore(store, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	size, _ := store.Size()
+	if size%BLOCK_SIZE != 0 {
+		t.Fatalf("expected a multiple of %d bytes, got %d", BLOCK_SIZE, size)
+	}
+
+	store.pastEOF = 0
+	tree, err = NewTreeFromStore(store, MinPrealloc(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if store.pastEOF != 0 {
+		t.Fatalf("opening read past the end %d times", store.pastEOF)
+	}
+	if val, err := tree.Find(100); err != nil || val != "test100" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+
+	if _, err := tree.seekNode(size); !errors.Is(err, ErrorOffsetOutOfRange) {
+		t.Fatalf("expected %v, got %v", ErrorOffsetOutOfRange, err)
+	}
+
+	// a block cut short is corrupt, not out of range
+	store.data = store.data[:size-BLOCK_SIZE+4]
+	if _, err := tree.seekNode(size - BLOCK_SIZE); !errors.Is(err, ErrorShortRead) {
+		t.Fatalf("expected %v, got %v", ErrorShortRead, err)
+	}
+}
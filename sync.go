@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// Sync writes out the blocks held back by CoalesceWrites and asks the
+// store to make everything written so far durable
+func (t *Tree) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.sync()
+}
+
+func (t *Tree) sync() error {
+	if err := t.flushDirty(); err != nil {
+		return err
+	}
+
+	if t.vals != nil {
+		if err := t.vals.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return t.file.Sync()
+}
+
+// startSyncLoop runs Sync every SyncInterval until stopSyncLoop. The first
+// error is kept and returned by Close.
+func (t *Tree) startSyncLoop() {
+	t.syncStop = make(chan struct{})
+	t.syncDone = make(chan struct{})
+
+	go func() {
+		defer close(t.syncDone)
+
+		ticker := time.NewTicker(t.syncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.syncStop:
+				return
+			case <-ticker.C:
+				t.mu.Lock()
+				if err := t.sync(); err != nil && t.syncErr == nil {
+					t.syncErr = err
+				}
+				t.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// stopSyncLoop must be called without holding t.mu, the loop may be
+// waiting for it
+func (t *Tree) stopSyncLoop() {
+	if t.syncStop == nil {
+		return
+	}
+
+	close(t.syncStop)
+	<-t.syncDone
+	t.syncStop = nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncInterval(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sync.db")
+
+	// buffered writes only reach the file through the sync loop
+	tree, err := NewTree(filename, CoalesceWrites(1000), SyncInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tree.mu.RLock()
+		pending := len(tree.dirty)
+		tree.mu.RUnlock()
+
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d blocks still buffered", pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// read the file through another handle as if the first one had died
+	other, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 100; i++ {
+		if val, err := other.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+	other.Close()
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.syncStop != nil {
+		t.Fatal("sync loop still running after Close")
+	}
+}
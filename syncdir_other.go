@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+// syncDir does nothing here, directories cannot be opened to be synced
+func syncDir(dir string) error {
+	return nil
+}
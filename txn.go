@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrorTxnClosed = errors.New("txn already committed or rolled back")
+var ErrorTxnUndoFailed = errors.New("txn undo failed, the tree may be inconsistent")
+
+// TxnUndoError is returned by Commit when an operation failed with Err and
+// undoing the ones applied before it failed as well, with Undo. The tree
+// may then hold part of the transaction. It matches both Err and
+// ErrorTxnUndoFailed with errors.Is.
+type TxnUndoError struct {
+	Err  error
+	Undo []error
+}
+
+func (e *TxnUndoError) Error() string {
+	undo := make([]string, len(e.Undo))
+	for i, err := range e.Undo {
+		undo[i] = err.Error()
+	}
+	return fmt.Sprintf("%v; %v: %s", e.Err, ErrorTxnUndoFailed, strings.Join(undo, "; "))
+}
+
+func (e *TxnUndoError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TxnUndoError) Is(target error) bool {
+	return target == ErrorTxnUndoFailed
+}
+
+const (
+	txnInsert = iota
+	txnUpdate
+	txnDelete
+)
+
+type txnOp struct {
+	kind int
+	key  int64
+	val  string
+}
+
+// Txn buffers writes and applies them together on Commit
+type Txn struct {
+	t      *Tree
+	ops    []txnOp
+	closed bool
+}
+
+// Begin starts a new transaction on the tree. Its writes are atomic only
+// to readers of this Tree: nothing is logged, so a crash during Commit can
+// leave part of them in the file, see Commit.
+func (t *Tree) Begin() *Txn {
+	return &Txn{t: t}
+}
+
+// Insert buffers an insert of the key
+func (tx *Txn) Insert(key int64, val string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnInsert, key: key, val: val})
+}
+
+// Update buffers an update of the key
+func (tx *Txn) Update(key int64, val string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnUpdate, key: key, val: val})
+}
+
+// Delete buffers a delete of the key
+func (tx *Txn) Delete(key int64) {
+	tx.ops = append(tx.ops, txnOp{kind: txnDelete, key: key})
+}
+
+// Commit applies the buffered operations in order under the write lock.
+// If one of them fails, the ones already applied are undone by writing
+// their inverse in reverse order, and its error is returned. An undo step
+// that fails too is skipped, the others still run, and the error is then
+// a *TxnUndoError: the tree may hold part of the transaction.
+// The all or nothing guarantee holds only within the process. Nothing is
+// journaled, so a crash or a failed write in the middle of Commit can leave
+// part of the transaction on disk, and reopening the file does not roll it
+// back or forward.
+func (tx *Txn) Commit() (err error) {
+	if tx.closed {
+		return ErrorTxnClosed
+	}
+	tx.closed = true
+
+	t := tx.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	undo := make([]txnOp, 0, len(tx.ops))
+	for _, op := range tx.ops {
+		inverse, err := t.applyTxnOp(op)
+		if err != nil {
+			var undoErrs []error
+			for i := len(undo) - 1; i >= 0; i-- {
+				if _, undoErr := t.applyTxnOp(undo[i]); undoErr != nil {
+					undoErrs = append(undoErrs, fmt.Errorf("undo key %d: %w", undo[i].key, undoErr))
+				}
+			}
+			if len(undoErrs) > 0 {
+				return &TxnUndoError{Err: err, Undo: undoErrs}
+			}
+			return err
+		}
+		undo = append(undo, inverse)
+	}
+
+	return nil
+}
+
+// Rollback discards the buffered operations
+func (tx *Txn) Rollback() error {
+	if tx.closed {
+		return ErrorTxnClosed
+	}
+	tx.closed = true
+	tx.ops = nil
+
+	return nil
+}
+
+// applyTxnOp applies op and returns the operation undoing it
+func (t *Tree) applyTxnOp(op txnOp) (txnOp, error) {
+	switch op.kind {
+	case txnInsert:
+		if err := t.insert(op.key, op.val); err != nil {
+			return txnOp{}, err
+		}
+		return txnOp{kind: txnDelete, key: op.key}, nil
+
+	case txnUpdate:
+		old, err := t.find(op.key)
+		if err != nil {
+			return txnOp{}, err
+		}
+		if err := t.update(op.key, op.val); err != nil {
+			return txnOp{}, err
+		}
+		return txnOp{kind: txnUpdate, key: op.key, val: old}, nil
+
+	default:
+		old, err := t.find(op.key)
+		if err != nil {
+			return txnOp{}, err
+		}
+		if err := t.deleteKey(op.key); err != nil {
+			return txnOp{}, err
+		}
+		return txnOp{kind: txnInsert, key: op.key, val: old}, nil
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTxnTestTree(t *testing.T) *Tree {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "txn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 10; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tree
+}
+
+func expectValues(t *testing.T, tree *Tree, want map[int64]string) {
+	t.Helper()
+
+	for key, val := range want {
+		got, err := tree.Find(key)
+		if val == "" {
+			if err != ErrorNotFoundKey {
+				t.Fatalf("key %d: expected %v, got %q, %v", key, ErrorNotFoundKey, got, err)
+			}
+			continue
+		}
+		if err != nil || got != val {
+			t.Fatalf("key %d: expected %q, got %q, %v", key, val, got, err)
+		}
+	}
+}
+
+func TestTxnCommit(t *testing.T) {
+	tree := newTxnTestTree(t)
+	defer tree.Close()
+
+	tx := tree.Begin()
+	tx.Insert(11, "test11")
+	tx.Update(5, "updated5")
+	tx.Delete(1)
+
+	// nothing is applied before Commit
+	expectValues(t, tree, map[int64]string{11: "", 5: "test5", 1: "test1"})
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValues(t, tree, map[int64]string{11: "test11", 5: "updated5", 1: ""})
+
+	if err := tx.Commit(); err != ErrorTxnClosed {
+		t.Fatalf("expected %v, got %v", ErrorTxnClosed, err)
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	tree := newTxnTestTree(t)
+	defer tree.Close()
+
+	tx := tree.Begin()
+	tx.Insert(11, "test11")
+	tx.Update(5, "updated5")
+	tx.Delete(1)
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValues(t, tree, map[int64]string{11: "", 5: "test5", 1: "test1"})
+
+	if err := tx.Commit(); err != ErrorTxnClosed {
+		t.Fatalf("expected %v, got %v", ErrorTxnClosed, err)
+	}
+}
+
+func TestTxnCommitFailureUndo(t *testing.T) {
+	tree := newTxnTestTree(t)
+	defer tree.Close()
+
+	tx := tree.Begin()
+	tx.Insert(11, "test11")
+	tx.Update(5, "updated5")
+	tx.Delete(1)
+	tx.Insert(2, "duplicated")
+
+	if err := tx.Commit(); err != ErrorHasExistedKey {
+		t.Fatalf("expected %v, got %v", ErrorHasExistedKey, err)
+	}
+
+	expectValues(t, tree, map[int64]string{11: "", 5: "test5", 1: "test1", 2: "test2"})
+}
+
+func TestTxnCommitUndoFailure(t *testing.T) {
+	tree := newTxnTestTree(t)
+	defer tree.Close()
+
+	// key 1 can be deleted but not inserted back
+	deletes := 0
+	tree.keyValidator = func(key int64) error {
+		if key != 1 {
+			return nil
+		}
+		if deletes++; deletes > 1 {
+			return errors.New("key 1 is locked")
+		}
+		return nil
+	}
+
+	tx := tree.Begin()
+	tx.Update(5, "updated5")
+	tx.Delete(1)
+	tx.Insert(2, "duplicated")
+
+	err := tx.Commit()
+	if !errors.Is(err, ErrorHasExistedKey) || !errors.Is(err, ErrorTxnUndoFailed) {
+		t.Fatalf("expected %v and %v, got %v", ErrorHasExistedKey, ErrorTxnUndoFailed, err)
+	}
+	var undoErr *TxnUndoError
+	if !errors.As(err, &undoErr) || len(undoErr.Undo) != 1 || !strings.Contains(undoErr.Undo[0].Error(), "key 1 is locked") {
+		t.Fatalf("expected the failed undo of key 1, got %v", err)
+	}
+
+	// the other undo steps still ran
+	expectValues(t, tree, map[int64]string{5: "test5", 1: "", 2: "test2"})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrorDuplicateValue = errors.New("duplicate value")
+
+// checkUnique rejects val if UniqueValues is on and another key than key
+// holds it
+func (t *Tree) checkUnique(key int64, val string) error {
+	if !t.uniqueValues {
+		return nil
+	}
+
+	if owner, ok := t.valueKeys[val]; ok && owner != key {
+		return fmt.Errorf("%w: %q is the value of %d", ErrorDuplicateValue, val, owner)
+	}
+
+	return nil
+}
+
+func (t *Tree) addValueKey(key int64, val string) {
+	if !t.uniqueValues {
+		return
+	}
+
+	if t.valueKeys == nil {
+		t.valueKeys = make(map[string]int64)
+	}
+	t.valueKeys[val] = key
+}
+
+func (t *Tree) removeValueKey(val string) {
+	if t.uniqueValues {
+		delete(t.valueKeys, val)
+	}
+}
+
+// loadValueKeys reads every value of the tree for UniqueValues
+func (t *Tree) loadValueKeys() error {
+	if !t.uniqueValues {
+		return nil
+	}
+
+	t.valueKeys = make(map[string]int64)
+	var err error
+	walkErr := t.ascendAll(func(key int64, val string) bool {
+		if err = t.checkUnique(key, val); err != nil {
+			return false
+		}
+		t.valueKeys[val] = key
+		return true
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	return err
+}
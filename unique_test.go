@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUniqueValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "unique.db")
+	tree, err := NewTree(filename, UniqueValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Insert(1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(2, "a"); !errors.Is(err, ErrorDuplicateValue) {
+		t.Fatalf("insert: expected %v, got %v", ErrorDuplicateValue, err)
+	}
+	if _, err := tree.Find(2); err != ErrorNotFoundKey {
+		t.Fatalf("expected the rejected key not to be stored, got %v", err)
+	}
+
+	if err := tree.Insert(2, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Update(2, "a"); !errors.Is(err, ErrorDuplicateValue) {
+		t.Fatalf("update: expected %v, got %v", ErrorDuplicateValue, err)
+	}
+	// a key keeps its own value
+	if err := tree.Update(2, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleted and replaced values are free again
+	if err := tree.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(3, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Update(2, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(4, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the values are read back on open
+	tree, err = NewTree(filename, UniqueValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(5, "c"); !errors.Is(err, ErrorDuplicateValue) {
+		t.Fatalf("after reopen: expected %v, got %v", ErrorDuplicateValue, err)
+	}
+	tree.Close()
+
+	// without the option duplicates are fine, but then the option can't
+	// be turned on
+	tree, err = NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert(5, "c"); err != nil {
+		t.Fatal(err)
+	}
+	tree.Close()
+
+	if _, err := NewTree(filename, UniqueValues()); !errors.Is(err, ErrorDuplicateValue) {
+		t.Fatalf("open: expected %v, got %v", ErrorDuplicateValue, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// VALUE_INDEX_SUFFIX is appended to the file name of a ValueIndex to name
+// the file of its secondary tree
+const VALUE_INDEX_SUFFIX = ".vidx"
+
+// ValueIndex pairs a tree with a secondary tree keyed by an int64 derived
+// from every value, to find the keys whose values fall in a range. Each
+// secondary entry lists the keys sharing a derived value.
+// Writes must go through the ValueIndex to keep both trees in step. They
+// are written one after the other, so an error in between leaves the
+// secondary tree stale.
+type ValueIndex struct {
+	mu      sync.RWMutex
+	primary *Tree
+	index   *Tree
+	derive  func(val string) int64
+}
+
+// NewValueIndex opens the tree in filename and its secondary tree next to
+// it, both with opts. derive must always be the one the index was built
+// with.
+func NewValueIndex(filename string, derive func(val string) int64, opts ...Option) (*ValueIndex, error) {
+	primary, err := NewTree(filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := NewTree(filename+VALUE_INDEX_SUFFIX, opts...)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+
+	return &ValueIndex{primary: primary, index: index, derive: derive}, nil
+}
+
+// ValuePrefix derives an int64 ordered like the first 8 bytes of val, so
+// that a ValueIndex built with it ranges over values in lexical order.
+// Values sharing their first 8 bytes share a derived value.
+func ValuePrefix(val string) int64 {
+	var buf [8]byte
+	copy(buf[:], val)
+
+	// flip the sign bit, so that bytes from 0x80 up sort last
+	return int64(binary.BigEndian.Uint64(buf[:]) ^ 1<<63)
+}
+
+// Tree returns the primary tree, for reads. Writing to it directly leaves
+// the secondary tree stale.
+func (vi *ValueIndex) Tree() *Tree {
+	return vi.primary
+}
+
+// Insert the key with its value, and index it under the value
+func (vi *ValueIndex) Insert(key int64, val string) error {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	if err := vi.primary.Insert(key, val); err != nil {
+		return err
+	}
+
+	return vi.addKey(vi.derive(val), key)
+}
+
+// Update the value of an existing key, and move it under the new value
+func (vi *ValueIndex) Update(key int64, val string) error {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	old, err := vi.primary.Find(key)
+	if err != nil {
+		return err
+	}
+
+	if err := vi.primary.Update(key, val); err != nil {
+		return err
+	}
+
+	if vi.derive(old) == vi.derive(val) {
+		return nil
+	}
+	if err := vi.removeKey(vi.derive(old), key); err != nil {
+		return err
+	}
+
+	return vi.addKey(vi.derive(val), key)
+}
+
+// Delete the key, and drop it from under its value
+func (vi *ValueIndex) Delete(key int64) error {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	old, err := vi.primary.Find(key)
+	if err != nil {
+		return err
+	}
+
+	if err := vi.primary.Delete(key); err != nil {
+		return err
+	}
+
+	return vi.removeKey(vi.derive(old), key)
+}
+
+// RangeByValue returns the keys whose derived values are in [lo, hi],
+// ordered by derived value, then by key
+func (vi *ValueIndex) RangeByValue(lo, hi int64) ([]int64, error) {
+	vi.mu.RLock()
+	defer vi.mu.RUnlock()
+
+	ikeys, lists, err := vi.index.RangeReverse(hi, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]int64, 0, len(ikeys))
+	for i := len(lists) - 1; i >= 0; i-- {
+		keys = append(keys, decodeKeyList(lists[i])...)
+	}
+
+	return keys, nil
+}
+
+// Close closes both trees
+func (vi *ValueIndex) Close() error {
+	err := vi.primary.Close()
+	if ierr := vi.index.Close(); err == nil {
+		err = ierr
+	}
+
+	return err
+}
+
+// addKey adds key to the list stored under ikey
+func (vi *ValueIndex) addKey(ikey, key int64) error {
+	list, err := vi.index.Find(ikey)
+	if err == ErrorNotFoundKey {
+		return vi.index.Insert(ikey, encodeKeyList([]int64{key}))
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := decodeKeyList(list)
+	idx := sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+	keys = append(keys, 0)
+	copy(keys[idx+1:], keys[idx:])
+	keys[idx] = key
+
+	return vi.index.Update(ikey, encodeKeyList(keys))
+}
+
+// removeKey removes key from the list stored under ikey, and the list
+// itself once empty
+func (vi *ValueIndex) removeKey(ikey, key int64) error {
+	list, err := vi.index.Find(ikey)
+	if err != nil {
+		return err
+	}
+
+	keys := decodeKeyList(list)
+	idx := sort.Search(len(keys), func(i int) bool { return keys[i] >= key })
+	if idx == len(keys) || keys[idx] != key {
+		return ErrorNotFoundKey
+	}
+	keys = append(keys[:idx], keys[idx+1:]...)
+
+	if len(keys) == 0 {
+		return vi.index.Delete(ikey)
+	}
+
+	return vi.index.Update(ikey, encodeKeyList(keys))
+}
+
+// encodeKeyList stores keys as little endian int64s one after the other
+func encodeKeyList(keys []int64) string {
+	buf := make([]byte, 8*len(keys))
+	for i, key := range keys {
+		binary.LittleEndian.PutUint64(buf[8*i:], uint64(key))
+	}
+
+	return string(buf)
+}
+
+func decodeKeyList(list string) []int64 {
+	keys := make([]int64, len(list)/8)
+	for i := range keys {
+		keys[i] = int64(binary.LittleEndian.Uint64([]byte(list[8*i : 8*i+8])))
+	}
+
+	return keys
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValueIndex(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "vidx.db")
+	vi, err := NewValueIndex(filename, ValuePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := map[int64]string{
+		1: "apple",
+		2: "banana",
+		3: "cherry",
+		4: "date",
+		5: "blueberry",
+		6: "banana",
+		7: "elder",
+	}
+	for key := int64(1); key <= 7; key++ {
+		if err := vi.Insert(key, pairs[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// values in ["b", "d"), by value then by key
+	lo, hi := ValuePrefix("b"), ValuePrefix("d")-1
+	keys, err := vi.RangeByValue(lo, hi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{2, 6, 5, 3}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %v, expected %v", keys, want)
+	}
+
+	if err := vi.Update(3, "avocado"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vi.Delete(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := vi.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if vi, err = NewValueIndex(filename, ValuePrefix); err != nil {
+		t.Fatal(err)
+	}
+	defer vi.Close()
+
+	if keys, err = vi.RangeByValue(lo, hi); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{2, 5}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %v, expected %v", keys, want)
+	}
+
+	if keys, err = vi.RangeByValue(ValuePrefix("a"), ValuePrefix("b")-1); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 3}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("got %v, expected %v", keys, want)
+	}
+	if val, err := vi.Tree().Find(3); err != nil || val != "avocado" {
+		t.Fatalf("got %q, %v", val, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// VALUES_SUFFIX is appended to the file name to get the side file of
+// SeparateValues
+const VALUES_SUFFIX = ".vals"
+
+// valuesName is the side file of the tree file name at generation gen,
+// which the header of the tree file records. Compact writes the next
+// generation so that the tree file, renamed last, never refers to a side
+// file it was not written with. Generation 0 has no number, like files
+// older than VALUES_GENERATION_VERSION.
+func valuesName(name string, gen uint32) string {
+	if gen == 0 {
+		return name + VALUES_SUFFIX
+	}
+	return fmt.Sprintf("%s%s.%d", name, VALUES_SUFFIX, gen)
+}
+
+// openValues opens the side file next to the tree file if the tree keeps
+// its values there, closing any side file opened before
+func (t *Tree) openValues() error {
+	if err := t.closeValues(); err != nil {
+		return err
+	}
+
+	if !t.separateValues {
+		return nil
+	}
+
+	f, ok := t.file.(fileStore)
+	if !ok {
+		return fmt.Errorf("separate values for %s: %w", t.file.Name(), ErrorNotAFile)
+	}
+
+	file, err := os.OpenFile(valuesName(f.Name(), t.valuesGen), os.O_CREATE|os.O_RDWR, t.fileMode)
+	if err != nil {
+		return err
+	}
+
+	t.vals = fileStore{file}
+	if t.valsSize, err = t.vals.Size(); err != nil {
+		t.closeValues()
+		return err
+	}
+
+	return nil
+}
+
+func (t *Tree) closeValues() error {
+	if t.vals == nil {
+		return nil
+	}
+
+	vals := t.vals
+	t.vals = nil
+
+	return vals.Close()
+}
+
+// appendValue writes data at the end of the side file. Values are never
+// overwritten in place, the space of replaced ones is only reclaimed by
+// Compact.
+func (t *Tree) appendValue(data []byte) (int64, error) {
+	off := t.valsSize
+	if n, err := t.vals.WriteAt(data, off); err != nil {
+		return 0, err
+	} else if n != len(data) {
+		return 0, fmt.Errorf("%w: writeat %d into %s, expected len = %d but get %d", io.ErrShortWrite, off, t.vals.Name(), len(data), n)
+	}
+
+	t.valsSize += int64(len(data))
+
+	return off, nil
+}
+
+func (t *Tree) readValue(off int64, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if n, err := t.vals.ReadAt(data, off); n != size {
+		return nil, fmt.Errorf("%w: read at %v from %v, expect len = %v but got %v: %v", ErrorShortRead, off, t.vals.Name(), size, n, err)
+	}
+
+	return data, nil
+}
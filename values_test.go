@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSeparateValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "separate.db")
+	tree, err := NewTree(filename, SeparateValues(), Order(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(i int64) string {
+		return strings.Repeat(fmt.Sprintf("%d,", i), int(i%50))
+	}
+
+	for i := int64(1); i <= 500; i++ {
+		if err := tree.Insert(i, value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 500; i += 3 {
+		if err := tree.Update(i, "updated"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(2); i <= 500; i += 7 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename + VALUES_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(tree *Tree) {
+		t.Helper()
+
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(1); i <= 500; i++ {
+			val, err := tree.Find(i)
+			switch {
+			case i%7 == 2:
+				if err != ErrorNotFoundKey {
+					t.Fatalf("key %d: expected %v, got %v", i, ErrorNotFoundKey, err)
+				}
+			case i%3 == 1:
+				if err != nil || val != "updated" {
+					t.Fatalf("key %d: got %q, %v", i, val, err)
+				}
+			default:
+				if err != nil || val != value(i) {
+					t.Fatalf("key %d: got %q, %v", i, val, err)
+				}
+			}
+		}
+	}
+
+	// the header tells the file keeps its values aside
+	if tree, err = NewTree(filename, Order(64)); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if !tree.separateValues {
+		t.Fatal("expected separate values from the header")
+	}
+	check(tree)
+
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(tree)
+
+	keys, err := tree.AllKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 500-72 {
+		t.Fatalf("expected %d keys, got %d", 500-72, len(keys))
+	}
+
+	// a partially read leaf must never be written back
+	leaf, err := tree.findLeafNode(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, err := tree.seekNodeKeys(leaf.Self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.flushNodeToDisk(partial); err == nil {
+		t.Fatal("expected an error writing a partial node")
+	}
+}
+
+func benchmarkAllKeys(b *testing.B, opts ...Option) {
+	tree, err := NewTree(filepath.Join(b.TempDir(), "bench.db"), opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tree.Close()
+
+	val := strings.Repeat("v", 200)
+	for i := int64(1); i <= 5000; i++ {
+		if err := tree.Insert(i, val); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	before := atomic.LoadInt64(&tree.reads)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := tree.AllKeys(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&tree.reads)-before)/float64(b.N), "reads/op")
+}
+
+// the largest orders whose leaves fit a block with 200 byte values inline,
+// and with only their offsets
+func BenchmarkAllKeysInline(b *testing.B) {
+	benchmarkAllKeys(b, Order(16))
+}
+
+func BenchmarkAllKeysSeparateValues(b *testing.B) {
+	benchmarkAllKeys(b, SeparateValues(), Order(128))
+}
@@ -0,0 +1,406 @@
+package main
+
+import "fmt"
+
+// Verify walks the whole tree and checks its structure: every node is
+// active with strictly increasing keys, parents point back at their
+// children and hold each child's last key, all leaves are at the same
+// depth and the leaf chain links them in order. It also checks that no
+// block is used twice, whether by two nodes, a node and an overflow page,
+// or something in use and the free list, and that the key counts of the
+// internal nodes are right.
+func (t *Tree) Verify() (err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	return t.verify()
+}
+
+type verifyState struct {
+	leafDepth int
+	lastLeaf  *Node
+	hasLast   bool
+	lastKey   int64
+	keys      int64          // keys in the leaves visited so far
+	used      map[int64]bool // blocks reached from the root
+}
+
+func (t *Tree) verify() error {
+	st := &verifyState{leafDepth: -1, used: make(map[int64]bool)}
+	if err := t.verifyTree(st); err != nil {
+		return err
+	}
+
+	free := make(map[int64]bool, len(t.freeBlocks))
+	for _, off := range t.freeBlocks {
+		if free[off] {
+			return fmt.Errorf("block at %d is in the free list more than once", off)
+		}
+		if st.used[off] {
+			return fmt.Errorf("block at %d is both free and in use", off)
+		}
+		free[off] = true
+	}
+
+	return nil
+}
+
+func (t *Tree) verifyTree(st *verifyState) error {
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	root, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return err
+	}
+
+	if root.Parent != INVALID_OFFSET {
+		return fmt.Errorf("root at %d has parent %d", root.Self, root.Parent)
+	}
+
+	if err := t.verifyNode(root, 0, st); err != nil {
+		return err
+	}
+
+	if st.lastLeaf.Next != INVALID_OFFSET {
+		return fmt.Errorf("last leaf at %d has next %d", st.lastLeaf.Self, st.lastLeaf.Next)
+	}
+
+	return nil
+}
+
+func (t *Tree) verifyNode(n *Node, depth int, st *verifyState) error {
+	if !n.IsActive {
+		return fmt.Errorf("node at %d is inactive", n.Self)
+	}
+
+	if err := st.use(n.Self); err != nil {
+		return err
+	}
+	for _, ref := range n.overflow {
+		for _, off := range ref.pages {
+			if err := st.use(off); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(n.Keys) == 0 {
+		return fmt.Errorf("node at %d has no keys", n.Self)
+	}
+
+	if err := n.checkKeysOrder(t.lessKey); err != nil {
+		return err
+	}
+
+	if st.hasLast && !t.lessKey(st.lastKey, n.Keys[0]) {
+		return fmt.Errorf("node at %d starts with key %d, not after %d", n.Self, n.Keys[0], st.lastKey)
+	}
+
+	if n.IsLeaf {
+		return st.visitLeaf(n, depth)
+	}
+
+	if len(n.Children) != len(n.Keys) {
+		return fmt.Errorf("node at %d has %d keys but %d children", n.Self, len(n.Keys), len(n.Children))
+	}
+
+	if t.hasCounts() && len(n.Counts) != len(n.Children) {
+		return fmt.Errorf("node at %d has %d children but %d counts", n.Self, len(n.Children), len(n.Counts))
+	}
+
+	for i, off := range n.Children {
+		child, err := t.seekNode(off)
+		if err != nil {
+			return err
+		}
+
+		if child.Self != off {
+			return fmt.Errorf("block at %d holds node %d", off, child.Self)
+		}
+
+		if child.Parent != n.Self {
+			return fmt.Errorf("node at %d has parent %d, expected %d", off, child.Parent, n.Self)
+		}
+
+		before := st.keys
+		if err := t.verifyNode(child, depth+1, st); err != nil {
+			return err
+		}
+
+		if t.hasCounts() && st.keys-before != n.Counts[i] {
+			return fmt.Errorf("node at %d counts %d keys under child %d which holds %d", n.Self, n.Counts[i], off, st.keys-before)
+		}
+
+		if st.lastKey != n.Keys[i] {
+			return fmt.Errorf("node at %d holds key %d for child %d whose last key is %d", n.Self, n.Keys[i], off, st.lastKey)
+		}
+	}
+
+	return nil
+}
+
+func (st *verifyState) use(off int64) error {
+	if st.used[off] {
+		return fmt.Errorf("block at %d is referenced more than once", off)
+	}
+	st.used[off] = true
+
+	return nil
+}
+
+func (st *verifyState) visitLeaf(leaf *Node, depth int) error {
+	if len(leaf.Values) != len(leaf.Keys) {
+		return fmt.Errorf("leaf at %d has %d keys but %d values", leaf.Self, len(leaf.Keys), len(leaf.Values))
+	}
+
+	if st.leafDepth == -1 {
+		st.leafDepth = depth
+	} else if st.leafDepth != depth {
+		return fmt.Errorf("leaf at %d is at depth %d, expected %d", leaf.Self, depth, st.leafDepth)
+	}
+
+	prevOff := int64(INVALID_OFFSET)
+	if st.lastLeaf != nil {
+		prevOff = st.lastLeaf.Self
+		if st.lastLeaf.Next != leaf.Self {
+			return fmt.Errorf("leaf at %d has next %d, expected %d", prevOff, st.lastLeaf.Next, leaf.Self)
+		}
+	}
+
+	if leaf.Prev != prevOff {
+		return fmt.Errorf("leaf at %d has prev %d, expected %d", leaf.Self, leaf.Prev, prevOff)
+	}
+
+	st.lastLeaf = leaf
+	st.lastKey = leaf.Keys[len(leaf.Keys)-1]
+	st.hasLast = true
+	st.keys += int64(len(leaf.Keys))
+
+	return nil
+}
+
+// rebuildFromLeaves frees every internal node and builds the internal
+// levels again bottom-up from the leaf chain
+func (t *Tree) rebuildFromLeaves() error {
+	size, err := t.storedSize()
+	if err != nil {
+		return err
+	}
+
+	var head *Node
+	for off := t.dataOff; off < size; off += int64(t.blockSize) {
+		node, err := t.seekNode(off)
+		if err != nil {
+			return err
+		}
+
+		if !node.IsActive || node.overflowPage {
+			continue
+		}
+
+		if !node.IsLeaf {
+			if err := t.freeNode(node); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if node.Prev == INVALID_OFFSET {
+			head = node
+		}
+	}
+
+	t.rootOff = INVALID_OFFSET
+	if head == nil {
+		return nil
+	}
+
+	level := []*Node{head}
+	for node := head; node.Next != INVALID_OFFSET; {
+		if node, err = t.seekNode(node.Next); err != nil {
+			return err
+		}
+		level = append(level, node)
+	}
+
+	for len(level) > 1 {
+		parents := make([]*Node, 0)
+		for i, child := range level {
+			if len(child.Keys) == 0 {
+				return ErrorInvalidDBFormat
+			}
+
+			if i%t.order == 0 {
+				parent, err := t.newNodeFromDisk()
+				if err != nil {
+					return err
+				}
+
+				if len(parents) != 0 {
+					prev := parents[len(parents)-1]
+					prev.Next = parent.Self
+					parent.Prev = prev.Self
+				}
+				parents = append(parents, parent)
+			}
+
+			parent := parents[len(parents)-1]
+			parent.Children = append(parent.Children, child.Self)
+			if t.hasCounts() {
+				parent.Counts = append(parent.Counts, child.keyCount())
+			}
+			parent.Keys = append(parent.Keys, child.Keys[len(child.Keys)-1])
+			child.Parent = parent.Self
+
+			if err := t.flushNodeToDisk(child); err != nil {
+				return err
+			}
+		}
+
+		level = parents
+	}
+
+	root := level[0]
+	root.Parent = INVALID_OFFSET
+	t.rootOff = root.Self
+
+	return t.flushNodeToDisk(root)
+}
+
+// relinkSplitLeaves adds to their parent the leaves the leaf chain goes
+// through but no parent holds, as left by a crash after a leaf split was
+// written but before its parent was. It returns how many were linked.
+func (t *Tree) relinkSplitLeaves() (int, error) {
+	if t.rootOff == INVALID_OFFSET {
+		return 0, nil
+	}
+
+	root, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return 0, err
+	}
+
+	var leaves []*Node
+	if err := t.collectLeaves(root, &leaves); err != nil {
+		return 0, err
+	}
+	held := make(map[int64]bool, len(leaves))
+	for _, leaf := range leaves {
+		held[leaf.Self] = true
+	}
+
+	relinked := 0
+	leaf := leaves[0]
+	for leaf.Next != INVALID_OFFSET {
+		next, err := t.seekNode(leaf.Next)
+		if err != nil {
+			return relinked, err
+		}
+		if held[next.Self] {
+			leaf = next
+			continue
+		}
+
+		if !next.IsActive || !next.IsLeaf || next.Prev != leaf.Self || len(next.Keys) == 0 {
+			return relinked, fmt.Errorf("%w: leaf at %d is followed by %d, not a leaf split off it", ErrorInvalidDBFormat, leaf.Self, next.Self)
+		}
+
+		// the split may have stopped before the leaf after it was updated
+		if next.Next != INVALID_OFFSET {
+			after, err := t.seekNode(next.Next)
+			if err != nil {
+				return relinked, err
+			}
+			if after.Prev != next.Self {
+				after.Prev = next.Self
+				if err := t.flushNodeToDisk(after); err != nil {
+					return relinked, err
+				}
+			}
+		}
+
+		next.Parent = leaf.Parent
+		if err := t.flushNodeToDisk(next); err != nil {
+			return relinked, err
+		}
+		if err := t.insertIntoParent(leaf, next); err != nil {
+			return relinked, err
+		}
+		held[next.Self] = true
+		relinked++
+
+		// splitting the parents may have moved next to another one
+		if leaf, err = t.seekNode(next.Self); err != nil {
+			return relinked, err
+		}
+	}
+
+	return relinked, nil
+}
+
+// RepairLinks rewrites the Next/Prev pointers of the leaves so that the
+// chain follows the order the parents give them in. Only leaves whose
+// pointers are wrong get written.
+func (t *Tree) RepairLinks() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	if t.rootOff == INVALID_OFFSET {
+		return nil
+	}
+
+	root, err := t.seekNode(t.rootOff)
+	if err != nil {
+		return err
+	}
+
+	var leaves []*Node
+	if err := t.collectLeaves(root, &leaves); err != nil {
+		return err
+	}
+
+	for i, leaf := range leaves {
+		prev, next := int64(INVALID_OFFSET), int64(INVALID_OFFSET)
+		if i > 0 {
+			prev = leaves[i-1].Self
+		}
+		if i < len(leaves)-1 {
+			next = leaves[i+1].Self
+		}
+
+		if leaf.Prev == prev && leaf.Next == next {
+			continue
+		}
+
+		leaf.Prev, leaf.Next = prev, next
+		if err := t.flushNodeToDisk(leaf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectLeaves appends the leaves under n from left to right
+func (t *Tree) collectLeaves(n *Node, leaves *[]*Node) error {
+	if n.IsLeaf {
+		*leaves = append(*leaves, n)
+		return nil
+	}
+
+	for _, off := range n.Children {
+		child, err := t.seekNode(off)
+		if err != nil {
+			return err
+		}
+		if err := t.collectLeaves(child, leaves); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "verify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 200; i += 3 {
+		if err := tree.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// break a separator key in the root
+	root, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Keys[0]--
+	if err := tree.flushNodeToDisk(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Verify(); err == nil {
+		t.Fatal("expected Verify to fail")
+	}
+}
+
+func TestRebuildFromLeaves(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rebuild.db")
+	tree, err := NewTree(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 200; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var internals []int64
+	err = tree.EachActiveNode(func(off int64, n *Node) error {
+		if !n.IsLeaf {
+			internals = append(internals, off)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(internals) == 0 {
+		t.Fatal("expected internal nodes")
+	}
+
+	zeros := make([]byte, tree.blockSize)
+	for _, off := range internals {
+		if _, err := tree.file.WriteAt(zeros, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewTree(filename); err != ErrorInvalidDBFormat {
+		t.Fatalf("expected %v, got %v", ErrorInvalidDBFormat, err)
+	}
+
+	tree, err = NewTree(filename, RebuildFromLeaves())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 200; i++ {
+		if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+			t.Fatalf("key %d: got %q, %v", i, val, err)
+		}
+	}
+
+	// the rebuilt tree keeps working
+	if err := tree.Insert(201, "test201"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairLinks(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// point a leaf in the middle back at the first leaf
+	first, err := tree.findLeafNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := tree.findLeafNode(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf.Prev = first.Self
+	if err := tree.flushNodeToDisk(leaf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Verify(); err == nil {
+		t.Fatal("expected the broken chain to fail verification")
+	}
+
+	if err := tree.RepairLinks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _, err := tree.RangeReverse(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 100 {
+		t.Fatalf("expected 100 keys, got %d: %v", len(keys), keys)
+	}
+	for i, key := range keys {
+		if key != int64(100-i) {
+			t.Fatalf("expected key %d at %d, got %d", 100-i, i, key)
+		}
+	}
+}
+
+func TestVerifySharedBlocks(t *testing.T) {
+	tree, err := NewTree(filepath.Join(t.TempDir(), "shared.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := int64(1); i <= 100; i++ {
+		if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a leaf still in the tree shows up in the free list
+	leaf, err := tree.findLeafNode(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.freeBlocks = append(tree.freeBlocks, leaf.Self)
+	if err := tree.Verify(); err == nil || !strings.Contains(err.Error(), "both free and in use") {
+		t.Fatalf("expected a free and used block, got %v", err)
+	}
+	tree.freeBlocks = tree.freeBlocks[:len(tree.freeBlocks)-1]
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the root lists its first child twice
+	root, err := tree.seekNode(tree.rootOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Children[1] = root.Children[0]
+	if err := tree.flushNodeToDisk(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Verify(); err == nil || !strings.Contains(err.Error(), "referenced more than once") {
+		t.Fatalf("expected a block referenced twice, got %v", err)
+	}
+}
+
+// splitWithoutParent goes through an insert of key up to the point where
+// the leaf has been split but its parent not yet told, as a crash would
+// leave it, the leaf after the split not pointing back at the new leaf
+func splitWithoutParent(t *testing.T, tree *Tree, key int64) {
+	t.Helper()
+
+	leaf, err := tree.findLeafNode(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.Keys) != tree.order || leaf.Next == INVALID_OFFSET {
+		t.Fatalf("leaf of %d is not a full leaf in the middle", key)
+	}
+
+	idx, err := leaf.insertKeyValIntoLeaf(tree, key, fmt.Sprintf("test%d", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.addToCounts(leaf, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.mayUpdateParentKeys(tree, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	newLeaf, err := tree.newNodeFromDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeaf.IsLeaf = true
+	if err := tree.splitLeafIntoTwoLeaves(leaf, newLeaf, cut(tree.order)); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := tree.seekNode(newLeaf.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after.Prev = leaf.Self
+	if err := tree.flushNodeToDisk(after); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelinkSplitLeaves(t *testing.T) {
+	for _, reopen := range []bool{false, true} {
+		filename := filepath.Join(t.TempDir(), "split.db")
+		tree, err := NewTree(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := int64(2); i <= 80; i += 2 {
+			if err := tree.Insert(i, fmt.Sprintf("test%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		splitWithoutParent(t, tree, 21)
+
+		if err := tree.Verify(); err == nil {
+			t.Fatal("expected Verify to fail after a partial split")
+		}
+
+		if reopen {
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tree, err = NewTree(filename, RebuildFromLeaves()); err != nil {
+				t.Fatal(err)
+			}
+		} else if n, err := tree.relinkSplitLeaves(); err != nil || n != 1 {
+			t.Fatalf("expected 1 leaf relinked, got %d, %v", n, err)
+		}
+
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(2); i <= 80; i += 2 {
+			if val, err := tree.Find(i); err != nil || val != fmt.Sprintf("test%d", i) {
+				t.Fatalf("key %d: got %q, %v", i, val, err)
+			}
+		}
+		if val, err := tree.Find(21); err != nil || val != "test21" {
+			t.Fatalf("key 21: got %q, %v", val, err)
+		}
+
+		tree.Close()
+	}
+}